@@ -0,0 +1,486 @@
+// Package bridge syncs the threads of Discord forum channels with Taiga user
+// stories. A Bridge holds all of its state, so several differently configured
+// bridges can run in one process next to other Discord handlers.
+package bridge
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"taiga-discord/taiga"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	SyncPoll    = "poll"
+	SyncWebhook = "webhook"
+)
+
+// Taiga is the part of the Taiga API the bridge uses. It is implemented by
+// *taiga.Client.
+type Taiga interface {
+	UserID(ctx context.Context) (int, error)
+	ListUserStories(ctx context.Context, projectId int, statusId int) ([]taiga.UserStory, error)
+	GetUserStory(ctx context.Context, id int) (taiga.UserStory, error)
+	CreateUserStory(ctx context.Context, story taiga.NewUserStory) (taiga.UserStory, error)
+	PatchUserStory(ctx context.Context, id int, version int, fields map[string]any) (taiga.UserStory, error)
+	DeleteUserStory(ctx context.Context, id int) error
+	BulkUpdateKanbanOrder(ctx context.Context, projectId int, statusId int, storyIds []int) error
+	GetUserStoryHistory(ctx context.Context, storyId int) ([]taiga.HistoryEntry, error)
+	AddComment(ctx context.Context, storyId int, version int, comment string) (taiga.UserStory, error)
+	EditComment(ctx context.Context, storyId int, commentId string, comment string) error
+	DeleteComment(ctx context.Context, storyId int, commentId string) error
+	UploadAttachment(ctx context.Context, projectId int, storyId int, filename string, content io.Reader) (taiga.Attachment, error)
+	ListAttachments(ctx context.Context, projectId int, storyId int) ([]taiga.Attachment, error)
+	DeleteAttachment(ctx context.Context, id int) error
+	ListUserStoryStatuses(ctx context.Context, projectId int) ([]taiga.Status, error)
+	GetProject(ctx context.Context, id int) (taiga.Project, error)
+	GetTagsColors(ctx context.Context, projectId int) (map[string]*string, error)
+	ListMemberships(ctx context.Context, projectId int) ([]taiga.Membership, error)
+	GetUserByUsername(ctx context.Context, username string) (taiga.User, error)
+	BaseURL() string
+}
+
+// Discord is the part of the Discord API the bridge uses. It is implemented by
+// *discordgo.Session, whose state the bridge also reads to save requests. The
+// bridge gets its events through AddHandler.
+type Discord interface {
+	AddHandler(handler any) func()
+	User(userId string, options ...discordgo.RequestOption) (*discordgo.User, error)
+	Channel(channelId string, options ...discordgo.RequestOption) (*discordgo.Channel, error)
+	ChannelEdit(channelId string, data *discordgo.ChannelEdit, options ...discordgo.RequestOption) (*discordgo.Channel, error)
+	ChannelMessage(channelId string, messageId string, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	ChannelMessages(channelId string, limit int, beforeId string, afterId string, aroundId string, options ...discordgo.RequestOption) ([]*discordgo.Message, error)
+	ChannelMessageSend(channelId string, content string, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	ChannelMessageSendComplex(channelId string, data *discordgo.MessageSend, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	ChannelMessageEditComplex(edit *discordgo.MessageEdit, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	ChannelMessageDelete(channelId string, messageId string, options ...discordgo.RequestOption) error
+	ForumThreadStartComplex(channelId string, thread *discordgo.ThreadStart, message *discordgo.MessageSend, options ...discordgo.RequestOption) (*discordgo.Channel, error)
+	GuildRoles(guildId string, options ...discordgo.RequestOption) ([]*discordgo.Role, error)
+	GuildThreadsActive(guildId string, options ...discordgo.RequestOption) (*discordgo.ThreadsList, error)
+	ThreadsArchived(channelId string, before *time.Time, limit int, options ...discordgo.RequestOption) (*discordgo.ThreadsList, error)
+	InteractionRespond(interaction *discordgo.Interaction, response *discordgo.InteractionResponse, options ...discordgo.RequestOption) error
+	InteractionResponseEdit(interaction *discordgo.Interaction, edit *discordgo.WebhookEdit, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	ApplicationCommands(appId string, guildId string, options ...discordgo.RequestOption) ([]*discordgo.ApplicationCommand, error)
+	ApplicationCommandBulkOverwrite(appId string, guildId string, commands []*discordgo.ApplicationCommand, options ...discordgo.RequestOption) ([]*discordgo.ApplicationCommand, error)
+}
+
+// DB is the storage of the bridge. It is implemented by *sql.DB, see OpenDB.
+type DB interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+type Config struct {
+	Taiga Taiga
+	// Discord is the session the bridge adds its handlers to, usually a
+	// *discordgo.Session. It needs the Guilds and GuildMessages intents and
+	// may be shared with other code.
+	// Without SyncEvents, discordgo hands events to the handlers in parallel
+	// and events of a thread that arrive at nearly the same time may be
+	// handled out of order. Bridges sharing a session answer the commands used
+	// in their own forums, the first one started registers the commands and
+	// answers the commands used anywhere else.
+	Discord Discord
+	// DB stores the mapping between threads and stories, see OpenDB. Its
+	// schema has to be brought up to date with Migrate.
+	DB DB
+
+	Projects []ProjectConfig
+	// SyncMode is how Taiga changes reach Discord: SyncPoll (default) checks
+	// every minute, SyncWebhook listens for Taiga webhooks on WebhookAddr.
+	SyncMode string
+	// WebhookAddr is the listen address for Taiga webhooks. Leave it empty to
+	// mount WebhookHandler on your own server instead.
+	WebhookAddr string
+	// MetricsAddr is the listen address for /metrics and /healthz, it may be
+	// the same as WebhookAddr. Leave it empty to mount MetricsHandler on your
+	// own server instead.
+	MetricsAddr string
+	// Workers is how many Discord events, and separately how many outbox
+	// jobs, are handled at the same time ( Default: 4 ). The events and jobs of
+	// one thread are always handled one after the other.
+	Workers int
+	// OutboxMaxAttempts is how often a failed write to Taiga is retried
+	// ( Default: 20 ).
+	OutboxMaxAttempts int
+	// ReconcileInterval runs Reconcile with fixing on a schedule when it is
+	// not zero.
+	ReconcileInterval time.Duration
+	// Logger receives the logs of the bridge ( Default: slog.Default() ).
+	Logger *slog.Logger
+}
+
+type ProjectConfig struct {
+	Id int
+	// ChannelId is the forum channel synced with the project.
+	ChannelId string
+	// DefaultStatus is the slug of the status of new stories, the project's
+	// default status when empty.
+	DefaultStatus string
+	// WebhookKey is the secret key of the project's Taiga webhook.
+	WebhookKey string
+	// PublishStories creates forum posts for stories created in Taiga. Only
+	// stories with one of PublishTags are published when it is not empty.
+	// It requires SyncWebhook.
+	PublishStories bool
+	PublishTags    []string
+	// ArchiveStatus is the slug of the status a story moves to when its
+	// thread is archived, the first closed status when empty.
+	ArchiveStatus string
+	// ReopenStatus is the slug of the status a story moves to when its thread
+	// is unarchived, DefaultStatus when empty.
+	ReopenStatus string
+	// ThreadDelete is what happens to a story when its thread is deleted:
+	// "archive" (default), "tag" or "delete".
+	ThreadDelete string
+	// Templates change the descriptions, comments and status messages the
+	// bridge writes.
+	Templates Templates
+	// StatusFormat is how a status change is announced in the thread: "embed"
+	// (default) or "text", which uses Templates.StatusUpdate. StatusFields
+	// are the details the embed shows, all of "changed_by", "assignee",
+	// "points" and "sprint" when empty.
+	StatusFormat string
+	StatusFields []string
+}
+
+type Bridge struct {
+	config    Config
+	taiga     Taiga
+	discord   Discord
+	db        DB
+	log       *slog.Logger
+	projects  map[int]ProjectConfig
+	templates map[int]*projectTemplates
+
+	statuses        *KanbanStatuses
+	channelProjects map[string]int
+
+	// botId is the Discord user of the bot, looked up by Start
+	botId string
+	// connected tracks the Discord gateway through the Ready, Resumed and
+	// Disconnect events
+	connected atomic.Bool
+
+	metadataCache map[int]ProjectMetadata
+	metadataLock  sync.Mutex
+
+	archiveChanges     map[string]int
+	archiveChangesLock sync.Mutex
+
+	// commentsSynced is the modified date of each story when the poll last
+	// synced its comments
+	commentsSynced map[int]string
+
+	outboxWake  chan struct{}
+	jobs        *queue
+	jobsRunning sync.WaitGroup
+	events      *queue
+	catchingUp  sync.Mutex
+	metrics     *metrics
+
+	ctx            context.Context
+	cancel         context.CancelFunc
+	workers        sync.WaitGroup
+	removeHandlers []func()
+	servers        []*http.Server
+
+	// jobsCtx outlives ctx so Shutdown can run the due jobs, it is canceled
+	// when Shutdown gives up
+	jobsCtx    context.Context
+	cancelJobs context.CancelFunc
+
+	// handlers counts the Discord events being handled, new ones are dropped
+	// once stopping is set
+	handlers     sync.WaitGroup
+	stopping     bool
+	stoppingLock sync.Mutex
+}
+
+// startedBridges are the running bridges of each Discord session, in the order
+// they started. Bridges sharing a session leave registering the commands, and
+// answering commands used outside of every bridge's forums, to the first one.
+var (
+	startedBridges     = make(map[Discord][]*Bridge)
+	startedBridgesLock sync.Mutex
+)
+
+// New checks the config and that the database schema is migrated.
+func New(config Config) (*Bridge, error) {
+	if config.Taiga == nil || config.Discord == nil || config.DB == nil {
+		return nil, errors.New("bridge: Taiga, Discord and DB are required")
+	}
+	switch config.SyncMode {
+	case "":
+		config.SyncMode = SyncPoll
+	case SyncPoll, SyncWebhook:
+	default:
+		return nil, errors.New("bridge: unknown sync mode " + config.SyncMode)
+	}
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+	if config.Workers < 1 {
+		config.Workers = 4
+	}
+	if config.OutboxMaxAttempts < 1 {
+		config.OutboxMaxAttempts = 20
+	}
+	err := checkSchema(config.DB)
+	if err != nil {
+		return nil, err
+	}
+	b := &Bridge{
+		config:          config,
+		taiga:           config.Taiga,
+		discord:         config.Discord,
+		db:              config.DB,
+		log:             config.Logger,
+		projects:        make(map[int]ProjectConfig),
+		templates:       make(map[int]*projectTemplates),
+		statuses:        newKanbanStatuses(),
+		channelProjects: make(map[string]int),
+		metadataCache:   make(map[int]ProjectMetadata),
+		archiveChanges:  make(map[string]int),
+		commentsSynced:  make(map[int]string),
+		outboxWake:      make(chan struct{}, 1),
+		jobs:            newQueue(config.Workers),
+		events:          newQueue(config.Workers),
+		metrics:         newMetrics(),
+	}
+	for _, project := range config.Projects {
+		if project.ChannelId == "" {
+			return nil, errors.New("bridge: project " + strconv.Itoa(project.Id) + " has no channel")
+		}
+		if project.PublishStories && config.SyncMode != SyncWebhook {
+			return nil, errors.New("bridge: project " + strconv.Itoa(project.Id) + " publishes stories, which requires the webhook sync mode")
+		}
+		templates, err := parseTemplates(project.Templates)
+		if err == nil {
+			err = checkStatusFormat(project)
+		}
+		if err == nil {
+			err = checkThreadDelete(project)
+		}
+		if err != nil {
+			return nil, errors.New("bridge: project " + strconv.Itoa(project.Id) + ": " + err.Error())
+		}
+		b.projects[project.Id] = project
+		b.templates[project.Id] = templates
+		b.channelProjects[project.ChannelId] = project.Id
+	}
+	return b, nil
+}
+
+// Start loads the statuses of every project, adds the Discord handlers and
+// starts syncing until ctx is done or Stop is called. The Discord session can
+// be opened before or after Start.
+func (b *Bridge) Start(ctx context.Context) error {
+	err := b.load(ctx)
+	if err != nil {
+		return err
+	}
+	bot, err := b.discord.User("@me")
+	if err != nil {
+		return err
+	}
+	b.botId = bot.ID
+	startedBridgesLock.Lock()
+	startedBridges[b.discord] = append(startedBridges[b.discord], b)
+	startedBridgesLock.Unlock()
+	b.ctx, b.cancel = context.WithCancel(ctx)
+	b.jobsCtx, b.cancelJobs = context.WithCancel(context.WithoutCancel(b.ctx))
+	b.removeHandlers = []func(){
+		b.discord.AddHandler(handle(b, "message_update", b.changeMessageEvent)),
+		b.discord.AddHandler(handle(b, "thread_update", b.changeTopicEvent)),
+		b.discord.AddHandler(handle(b, "message_create", b.createThreadEvent)),
+		b.discord.AddHandler(handle(b, "message_delete", b.deleteMessageEvent)),
+		b.discord.AddHandler(handle(b, "message_delete_bulk", b.deleteMessagesEvent)),
+		b.discord.AddHandler(handle(b, "thread_archive", b.threadArchiveEvent)),
+		b.discord.AddHandler(handle(b, "thread_delete", b.threadDeleteEvent)),
+		b.discord.AddHandler(handle(b, "interaction_create", b.interactionEvent)),
+		b.discord.AddHandler(handle(b, "ready", b.registerCommands)),
+		b.discord.AddHandler(handle(b, "ready", b.readyEvent)),
+		b.discord.AddHandler(handle(b, "resumed", b.resumedEvent)),
+		b.discord.AddHandler(handle(b, "disconnect", b.disconnectEvent)),
+	}
+	ctx = b.ctx
+	if session, ok := b.discord.(*discordgo.Session); ok && session.State != nil && session.State.User != nil {
+		// the session is already open and missed the Ready event
+		ready := &discordgo.Ready{User: session.State.User}
+		handle(b, "ready", b.registerCommands)(session, ready)
+		handle(b, "ready", b.readyEvent)(session, ready)
+	}
+	b.run(func() { b.runOutbox(ctx) })
+	b.startServers()
+	if b.config.SyncMode == SyncPoll {
+		b.run(func() { b.checkStatuses(ctx) })
+	}
+	if b.config.ReconcileInterval > 0 {
+		b.run(func() { b.runReconcile(ctx) })
+	}
+	return nil
+}
+
+// load fetches the statuses of every project and matches them to forum tags.
+func (b *Bridge) load(ctx context.Context) error {
+	for projectId := range b.projects {
+		err := b.setupStatuses(ctx, projectId)
+		if err != nil {
+			return err
+		}
+		err = b.setupStatusTags(projectId)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run starts a worker that Shutdown waits for, unless the bridge is stopping.
+func (b *Bridge) run(worker func()) {
+	b.stoppingLock.Lock()
+	defer b.stoppingLock.Unlock()
+	if b.stopping {
+		return
+	}
+	b.workers.Add(1)
+	go func() {
+		defer b.workers.Done()
+		defer b.recoverPanic(context.Background())
+		worker()
+	}()
+}
+
+// Shutdown stops taking Discord events and webhooks, cancels polling and
+// waits for the events and jobs being handled. Then it runs the outbox jobs
+// that are due, so nothing queued before the shutdown waits for the next
+// start. It gives up when ctx is done, canceling the jobs still running, and
+// returns ctx's error along with any error stopping the servers. It does not
+// close the Discord session or the database.
+func (b *Bridge) Shutdown(ctx context.Context) error {
+	b.stoppingLock.Lock()
+	b.stopping = true
+	b.stoppingLock.Unlock()
+	for _, remove := range b.removeHandlers {
+		remove()
+	}
+	b.removeHandlers = nil
+	startedBridgesLock.Lock()
+	startedBridges[b.discord] = slices.DeleteFunc(startedBridges[b.discord], func(other *Bridge) bool { return other == b })
+	if len(startedBridges[b.discord]) == 0 {
+		delete(startedBridges, b.discord)
+	}
+	startedBridgesLock.Unlock()
+	var serverErr error
+	for _, server := range b.servers {
+		serverErr = cmp.Or(serverErr, server.Shutdown(ctx))
+	}
+	b.servers = nil
+	if b.cancel != nil {
+		b.cancel()
+	}
+	if b.cancelJobs != nil {
+		defer b.cancelJobs()
+	}
+	if !wait(ctx, &b.handlers) || !wait(ctx, &b.workers) || !wait(ctx, &b.jobsRunning) {
+		return errors.Join(serverErr, ctx.Err())
+	}
+	for ctx.Err() == nil && b.dispatchJobs(ctx) > 0 {
+		if !wait(ctx, &b.jobsRunning) {
+			break
+		}
+	}
+	return errors.Join(serverErr, ctx.Err())
+}
+
+// Stop is Shutdown without a deadline.
+func (b *Bridge) Stop() {
+	b.Shutdown(context.Background())
+}
+
+// acceptEvent counts an event as being handled, unless the bridge is
+// stopping.
+func (b *Bridge) acceptEvent() bool {
+	b.stoppingLock.Lock()
+	defer b.stoppingLock.Unlock()
+	if b.stopping {
+		return false
+	}
+	b.handlers.Add(1)
+	return true
+}
+
+// wait waits for group and reports whether it finished before ctx was done.
+func wait(ctx context.Context, group *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		group.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// startServers listens for webhooks and metrics, on one server when they
+// share an address.
+func (b *Bridge) startServers() {
+	handlers := make(map[string]*http.ServeMux)
+	mount := func(addr string, handler http.Handler, patterns ...string) {
+		if addr == "" {
+			return
+		}
+		if handlers[addr] == nil {
+			handlers[addr] = http.NewServeMux()
+		}
+		for _, pattern := range patterns {
+			handlers[addr].Handle(pattern, handler)
+		}
+	}
+	if b.config.SyncMode == SyncWebhook {
+		mount(b.config.WebhookAddr, b.WebhookHandler(), "/webhooks/")
+	}
+	mount(b.config.MetricsAddr, b.MetricsHandler(), "/metrics", "/healthz")
+	for addr, handler := range handlers {
+		server := &http.Server{Addr: addr, Handler: handler}
+		b.servers = append(b.servers, server)
+		b.run(func() { b.serve(server) })
+	}
+}
+
+func (b *Bridge) serve(server *http.Server) {
+	err := server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		b.log.Error("Error serving", "addr", server.Addr, "error", err)
+	}
+}
+
+func (b *Bridge) project(projectId int) ProjectConfig {
+	return b.projects[projectId]
+}
+
+// state is the cache of the gateway when Discord is a *discordgo.Session, nil
+// otherwise.
+func (b *Bridge) state() *discordgo.State {
+	if session, ok := b.discord.(*discordgo.Session); ok {
+		return session.State
+	}
+	return nil
+}
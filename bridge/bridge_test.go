@@ -0,0 +1,205 @@
+package bridge
+
+import (
+	"context"
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"taiga-discord/taiga"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// fakeTaiga answers the Taiga calls a test needs, the others panic through
+// the nil embedded interface.
+type fakeTaiga struct {
+	Taiga
+	userId  int
+	stories map[int]taiga.UserStory
+	history map[int][]taiga.HistoryEntry
+	// historyCalls are the stories whose history was fetched
+	historyCalls []int
+	// deletedComments are the ids of the deleted comments
+	deletedComments []string
+	users           []taiga.User
+	// projectErrors are returned by GetProject
+	projectErrors map[int]error
+	// statuses are the statuses of every project
+	statuses []taiga.Status
+	patches  []map[string]any
+	// conflicts change the story as if someone else edited it, one before
+	// each patch until they are used up
+	conflicts []func(story *taiga.UserStory)
+}
+
+func (f *fakeTaiga) UserID(ctx context.Context) (int, error) {
+	return f.userId, nil
+}
+
+func (f *fakeTaiga) GetUserStory(ctx context.Context, id int) (taiga.UserStory, error) {
+	story, ok := f.stories[id]
+	if !ok {
+		return story, taiga.ErrNotFound
+	}
+	return story, nil
+}
+
+func (f *fakeTaiga) PatchUserStory(ctx context.Context, id int, version int, fields map[string]any) (taiga.UserStory, error) {
+	story := f.stories[id]
+	if len(f.conflicts) > 0 {
+		f.conflicts[0](&story)
+		f.conflicts = f.conflicts[1:]
+		story.Version++
+		f.stories[id] = story
+	}
+	if story.Version != version {
+		return story, taiga.ErrVersionConflict
+	}
+	f.patches = append(f.patches, fields)
+	if description, ok := fields["description"].(string); ok {
+		story.Description = description
+	}
+	story.Version++
+	f.stories[id] = story
+	return story, nil
+}
+
+func (f *fakeTaiga) GetUserStoryHistory(ctx context.Context, storyId int) ([]taiga.HistoryEntry, error) {
+	f.historyCalls = append(f.historyCalls, storyId)
+	return f.history[storyId], nil
+}
+
+func (f *fakeTaiga) DeleteComment(ctx context.Context, storyId int, commentId string) error {
+	f.deletedComments = append(f.deletedComments, commentId)
+	return nil
+}
+
+func (f *fakeTaiga) ListUserStoryStatuses(ctx context.Context, projectId int) ([]taiga.Status, error) {
+	return f.statuses, nil
+}
+
+func (f *fakeTaiga) GetProject(ctx context.Context, id int) (taiga.Project, error) {
+	if err := f.projectErrors[id]; err != nil {
+		return taiga.Project{}, err
+	}
+	project := taiga.Project{Id: id, Slug: "project"}
+	if len(f.statuses) > 0 {
+		project.DefaultUsStatus = f.statuses[0].Id
+	}
+	return project, nil
+}
+
+func (f *fakeTaiga) GetUserByUsername(ctx context.Context, username string) (taiga.User, error) {
+	for _, user := range f.users {
+		if user.Username == username {
+			return user, nil
+		}
+	}
+	return taiga.User{}, taiga.ErrNotFound
+}
+
+func (f *fakeTaiga) BaseURL() string {
+	return "https://taiga.example"
+}
+
+// fakeDiscord keeps the application's commands, the other calls panic through
+// the nil embedded interface.
+type fakeDiscord struct {
+	Discord
+	commands []*discordgo.ApplicationCommand
+}
+
+func (f *fakeDiscord) ApplicationCommands(appId string, guildId string, options ...discordgo.RequestOption) ([]*discordgo.ApplicationCommand, error) {
+	return f.commands, nil
+}
+
+func (f *fakeDiscord) ApplicationCommandBulkOverwrite(appId string, guildId string, commands []*discordgo.ApplicationCommand, options ...discordgo.RequestOption) ([]*discordgo.ApplicationCommand, error) {
+	f.commands = commands
+	return commands, nil
+}
+
+// newTestBridge creates a bridge on a migrated database in a temporary
+// directory, in the webhook sync mode. Without projects it syncs project 1
+// with the forum channel "forum".
+func newTestBridge(t *testing.T, fake *fakeTaiga, projects ...ProjectConfig) *Bridge {
+	t.Helper()
+	db, err := OpenDB(filepath.Join(t.TempDir(), "tasks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	_, err = Migrate(db, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	discord, err := discordgo.New("Bot test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.stories == nil {
+		fake.stories = make(map[int]taiga.UserStory)
+	}
+	if len(projects) == 0 {
+		projects = []ProjectConfig{{Id: 1, ChannelId: "forum"}}
+	}
+	b, err := New(Config{
+		Taiga:    fake,
+		Discord:  discord,
+		DB:       db,
+		Logger:   slog.New(slog.DiscardHandler),
+		Projects: projects,
+		SyncMode: SyncWebhook,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestNewRejectsPublishingWithoutWebhooks(t *testing.T) {
+	discord, _ := discordgo.New("Bot test")
+	db, err := OpenDB(filepath.Join(t.TempDir(), "tasks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = Migrate(db, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		syncMode string
+		wantErr  bool
+	}{
+		{"", true},
+		{SyncPoll, true},
+		{SyncWebhook, false},
+	}
+	for _, test := range tests {
+		_, err := New(Config{
+			Taiga:    &fakeTaiga{},
+			Discord:  discord,
+			DB:       db,
+			SyncMode: test.syncMode,
+			Projects: []ProjectConfig{{Id: 1, ChannelId: "forum", PublishStories: true}},
+		})
+		if (err != nil) != test.wantErr {
+			t.Errorf("sync mode %q: got error %v, want error %v", test.syncMode, err, test.wantErr)
+		}
+	}
+}
+
+func TestRunAfterShutdown(t *testing.T) {
+	b := newTestBridge(t, &fakeTaiga{})
+	err := b.Shutdown(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ran := false
+	b.run(func() { ran = true })
+	b.workers.Wait()
+	if ran {
+		t.Error("a worker started after Shutdown")
+	}
+}
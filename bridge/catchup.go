@@ -0,0 +1,242 @@
+package bridge
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Messages posted while the bot was offline are caught up on when it connects.
+// sync_marks keeps the newest message synced in every thread and the newest
+// thread seen in every forum channel, and when the thread was last synced, so
+// edits made after that are replayed too.
+
+const catchUpArchivedLimit = 50
+
+// markSynced moves the mark of a thread or forum channel to messageId, unless
+// it is already past it, and records that it was synced now.
+func (b *Bridge) markSynced(channelId string, messageId string) error {
+	_, err := b.db.Exec("INSERT INTO sync_marks (channel_id, message_id, synced_at) VALUES (?, ?, ?) ON CONFLICT(channel_id) DO UPDATE SET message_id = MAX(message_id, excluded.message_id), synced_at = excluded.synced_at", channelId, snowflake(messageId), time.Now().UnixMilli())
+	return err
+}
+
+// getSyncMark returns the newest synced message of a channel and when it was
+// last synced.
+func (b *Bridge) getSyncMark(channelId string) (int64, time.Time, bool, error) {
+	var messageId int64
+	var syncedAt int64
+	err := b.db.QueryRow("SELECT message_id, synced_at FROM sync_marks WHERE channel_id = ?", channelId).Scan(&messageId, &syncedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, time.Time{}, false, nil
+	}
+	if err != nil {
+		return 0, time.Time{}, false, err
+	}
+	return messageId, time.UnixMilli(syncedAt), true, nil
+}
+
+func (b *Bridge) readyEvent(ctx context.Context, s *discordgo.Session, r *discordgo.Ready) {
+	b.connected.Store(true)
+	b.run(func() { b.catchUp(detach(b.ctx, ctx)) })
+}
+
+func (b *Bridge) resumedEvent(ctx context.Context, s *discordgo.Session, r *discordgo.Resumed) {
+	b.connected.Store(true)
+	b.run(func() { b.catchUp(detach(b.ctx, ctx)) })
+}
+
+func (b *Bridge) disconnectEvent(ctx context.Context, s *discordgo.Session, d *discordgo.Disconnect) {
+	b.connected.Store(false)
+}
+
+// catchUp replays what was missed in the active and recently archived threads
+// of every forum channel. Replaying is safe, jobs skip messages that are
+// already synced.
+func (b *Bridge) catchUp(ctx context.Context) {
+	if !b.catchingUp.TryLock() {
+		return
+	}
+	defer b.catchingUp.Unlock()
+	for channelId, projectId := range b.channelProjects {
+		if ctx.Err() != nil {
+			return
+		}
+		err := b.catchUpChannel(b.withLog(ctx, "project_id", projectId), projectId, channelId)
+		if err != nil {
+			b.logger(ctx).Error("Error catching up on channel", "project_id", projectId, "channel_id", channelId, "error", err)
+		}
+	}
+}
+
+func (b *Bridge) catchUpChannel(ctx context.Context, projectId int, channelId string) error {
+	channel, err := b.discord.Channel(channelId)
+	if err != nil {
+		return err
+	}
+	active, err := b.discord.GuildThreadsActive(channel.GuildID)
+	if err != nil {
+		return err
+	}
+	archived, err := b.discord.ThreadsArchived(channelId, nil, catchUpArchivedLimit)
+	if err != nil {
+		return err
+	}
+	var threads []*discordgo.Channel
+	for _, thread := range append(active.Threads, archived.Threads...) {
+		if thread.ParentID == channelId {
+			threads = append(threads, thread)
+		}
+	}
+	sort.Slice(threads, func(i, j int) bool {
+		return snowflake(threads[i].ID) < snowflake(threads[j].ID)
+	})
+	newestThread, _, known, err := b.getSyncMark(channelId)
+	if err != nil {
+		return err
+	}
+	if !known {
+		// without a mark every existing thread would look new, start from now on
+		newest := ""
+		if len(threads) > 0 {
+			newest = threads[len(threads)-1].ID
+		}
+		err = b.markSynced(channelId, newest)
+		if err != nil {
+			return err
+		}
+		newestThread = snowflake(newest)
+	}
+	for _, thread := range threads {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err = b.catchUpThread(ctx, projectId, thread, snowflake(thread.ID) > newestThread)
+		if err != nil {
+			b.logger(ctx).Error("Error catching up on thread", "thread_id", thread.ID, "error", err)
+		}
+	}
+	return nil
+}
+
+// catchUpThread queues the messages of a thread that are newer than its mark,
+// and the messages edited since it was last synced. A thread that is not
+// synced yet is only created when it is newer than the channel's mark.
+func (b *Bridge) catchUpThread(ctx context.Context, projectId int, thread *discordgo.Channel, isNew bool) error {
+	_, statusId, mapped, err := b.getThreadMapping(thread.ID)
+	if err != nil {
+		return err
+	}
+	lastMessage, syncedAt, known, err := b.getSyncMark(thread.ID)
+	if err != nil {
+		return err
+	}
+	if mapped && !known {
+		// synced before there were marks, start from now on
+		return b.markSynced(thread.ID, thread.LastMessageID)
+	}
+	if !mapped {
+		if !isNew {
+			return nil
+		}
+		pending, err := b.hasPendingJobs(thread.ID)
+		if err != nil || pending {
+			return err
+		}
+		starter, err := b.discord.ChannelMessage(thread.ID, thread.ID)
+		if err != nil {
+			return err
+		}
+		if starter.Author != nil && starter.Author.ID != b.botId {
+			err = b.syncMessage(ctx, projectId, thread, starter, true)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// the first message shares its id with the thread and is never a comment
+	messages, err := b.threadMessagesAfter(thread.ID, max(lastMessage, snowflake(thread.ID)))
+	if err != nil {
+		return err
+	}
+	for _, message := range messages {
+		if message.Author == nil || message.Author.ID == b.botId {
+			continue
+		}
+		err = b.syncMessage(ctx, projectId, thread, message, false)
+		if err != nil {
+			return err
+		}
+	}
+	if mapped {
+		err = b.catchUpEdits(ctx, projectId, thread.ID, syncedAt)
+		if err != nil {
+			return err
+		}
+		status, statusTagCount, found := b.appliedStatus(projectId, thread.AppliedTags, statusId)
+		if found && (status.Id != statusId || statusTagCount != 1) {
+			b.enqueueJob(ctx, thread.ID, "update_status", UpdateStatusJob{ProjectId: projectId, StatusId: status.Id})
+		}
+	}
+	return b.markSynced(thread.ID, "")
+}
+
+// threadMessagesAfter returns the messages of a thread after the given id,
+// oldest first.
+func (b *Bridge) threadMessagesAfter(threadId string, after int64) ([]*discordgo.Message, error) {
+	var messages []*discordgo.Message
+	for {
+		page, err := b.discord.ChannelMessages(threadId, 100, "", strconv.FormatInt(after, 10), "")
+		if err != nil {
+			return nil, err
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, message := range page {
+			after = max(after, snowflake(message.ID))
+		}
+		messages = append(messages, page...)
+		if len(page) < 100 {
+			break
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return snowflake(messages[i].ID) < snowflake(messages[j].ID)
+	})
+	return messages, nil
+}
+
+// catchUpEdits replays the edits made to the last 100 messages of a thread
+// since it was last synced.
+func (b *Bridge) catchUpEdits(ctx context.Context, projectId int, threadId string, syncedAt time.Time) error {
+	messages, err := b.discord.ChannelMessages(threadId, 100, "", "", "")
+	if err != nil {
+		return err
+	}
+	for i := len(messages) - 1; i >= 0; i-- {
+		message := messages[i]
+		if message.Author == nil || message.Author.ID == b.botId {
+			continue
+		}
+		if message.EditedTimestamp != nil && message.EditedTimestamp.After(syncedAt) {
+			b.enqueueJob(ctx, threadId, "update_message", MessageJob{ProjectId: projectId, Message: message})
+		}
+	}
+	return nil
+}
+
+func (b *Bridge) hasPendingJobs(threadId string) (bool, error) {
+	var count int
+	err := b.db.QueryRow("SELECT COUNT(*) FROM jobs WHERE thread_id = ? AND state = ?", threadId, jobPending).Scan(&count)
+	return count > 0, err
+}
+
+func snowflake(id string) int64 {
+	value, _ := strconv.ParseInt(id, 10, 64)
+	return value
+}
@@ -0,0 +1,42 @@
+package bridge
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Database errors end the catch-up of a thread with an error, so the next
+// catch-up tries it again, instead of a panic.
+func TestCatchUpReturnsDatabaseErrors(t *testing.T) {
+	thread := &discordgo.Channel{ID: "100", ParentID: "10", Name: "Bug"}
+	message := &discordgo.Message{ID: "101", ChannelID: thread.ID, Author: &discordgo.User{ID: "1"}}
+	tests := []struct {
+		name  string
+		table string
+		run   func(b *Bridge) error
+	}{
+		{"sync mark", "sync_marks", func(b *Bridge) error {
+			return b.catchUpThread(context.Background(), 1, thread, true)
+		}},
+		{"pending jobs", "jobs", func(b *Bridge) error {
+			return b.catchUpThread(context.Background(), 1, thread, true)
+		}},
+		{"sync message", "sync_marks", func(b *Bridge) error {
+			return b.syncMessage(context.Background(), 1, thread, message, false)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newTestBridge(t, &fakeTaiga{})
+			_, err := b.db.Exec("DROP TABLE " + test.table)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := test.run(b); err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
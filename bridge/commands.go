@@ -0,0 +1,617 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"taiga-discord/taiga"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const autocompleteLimit = 25
+
+const (
+	commandTimeout = 30 * time.Second
+	// autocompleteTimeout is shorter than the 3 seconds Discord waits for
+	// choices, slower choices are useless
+	autocompleteTimeout = 2500 * time.Millisecond
+)
+
+var dmPermission = false
+
+var storyCommands = []*discordgo.ApplicationCommand{
+	{
+		Name:         "status",
+		Description:  "Move the user story of this thread to another status",
+		DMPermission: &dmPermission,
+		Options: []*discordgo.ApplicationCommandOption{
+			{Type: discordgo.ApplicationCommandOptionString, Name: "status", Description: "New status", Required: true, Autocomplete: true},
+		},
+	},
+	{
+		Name:         "assign",
+		Description:  "Assign the user story of this thread",
+		DMPermission: &dmPermission,
+		Options: []*discordgo.ApplicationCommandOption{
+			{Type: discordgo.ApplicationCommandOptionString, Name: "member", Description: "Project member", Autocomplete: true},
+			{Type: discordgo.ApplicationCommandOptionUser, Name: "user", Description: "Discord member with a linked Taiga account"},
+		},
+	},
+	{
+		Name:         "points",
+		Description:  "Estimate the user story of this thread",
+		DMPermission: &dmPermission,
+		Options: []*discordgo.ApplicationCommandOption{
+			{Type: discordgo.ApplicationCommandOptionString, Name: "points", Description: "Points", Required: true, Autocomplete: true},
+			{Type: discordgo.ApplicationCommandOptionString, Name: "role", Description: "Role to estimate for", Autocomplete: true},
+		},
+	},
+	{
+		Name:         "due",
+		Description:  "Set the due date of the user story of this thread",
+		DMPermission: &dmPermission,
+		Options: []*discordgo.ApplicationCommandOption{
+			{Type: discordgo.ApplicationCommandOptionString, Name: "date", Description: "Due date as YYYY-MM-DD, or none", Required: true},
+		},
+	},
+	{
+		Name:         "tag",
+		Description:  "Change the Taiga tags of the user story of this thread",
+		DMPermission: &dmPermission,
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "add",
+				Description: "Add a tag",
+				Options: []*discordgo.ApplicationCommandOption{
+					{Type: discordgo.ApplicationCommandOptionString, Name: "tag", Description: "Tag", Required: true, Autocomplete: true},
+				},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "remove",
+				Description: "Remove a tag",
+				Options: []*discordgo.ApplicationCommandOption{
+					{Type: discordgo.ApplicationCommandOptionString, Name: "tag", Description: "Tag", Required: true, Autocomplete: true},
+				},
+			},
+		},
+	},
+	{
+		Name:         "block",
+		Description:  "Block or unblock the user story of this thread",
+		DMPermission: &dmPermission,
+		Options: []*discordgo.ApplicationCommandOption{
+			{Type: discordgo.ApplicationCommandOptionBoolean, Name: "blocked", Description: "Whether the story is blocked ( Default: true )"},
+			{Type: discordgo.ApplicationCommandOptionString, Name: "reason", Description: "Why the story is blocked"},
+		},
+	},
+}
+
+// bridgeCommands are the commands the bridge registers.
+func bridgeCommands() []*discordgo.ApplicationCommand {
+	return append(slices.Clone(storyCommands), linkCommand)
+}
+
+func isBridgeCommand(name string) bool {
+	return slices.ContainsFunc(bridgeCommands(), func(command *discordgo.ApplicationCommand) bool { return command.Name == name })
+}
+
+// leadsSession reports whether the bridge is the first running bridge of its
+// Discord session, or runs on its own.
+func (b *Bridge) leadsSession() bool {
+	startedBridgesLock.Lock()
+	defer startedBridgesLock.Unlock()
+	bridges := startedBridges[b.discord]
+	return len(bridges) == 0 || bridges[0] == b
+}
+
+// answersCommand reports whether the bridge answers a command used in a
+// channel, so bridges sharing a session answer every interaction once. The
+// bridge syncing the channel's forum answers, the first bridge of the session
+// answers when no bridge syncs it.
+func (b *Bridge) answersCommand(channelId string) bool {
+	if b.syncsChannel(channelId) {
+		return true
+	}
+	if !b.leadsSession() {
+		return false
+	}
+	startedBridgesLock.Lock()
+	bridges := slices.Clone(startedBridges[b.discord])
+	startedBridgesLock.Unlock()
+	return !slices.ContainsFunc(bridges, func(other *Bridge) bool { return other != b && other.syncsChannel(channelId) })
+}
+
+// syncsChannel reports whether a thread is in one of the bridge's forums.
+func (b *Bridge) syncsChannel(channelId string) bool {
+	channel, err := b.channel(channelId)
+	if err != nil {
+		return false
+	}
+	_, ok := b.channelProjects[channel.ParentID]
+	return ok
+}
+
+// registerCommands syncs the bridge's commands with Discord in one request,
+// keeping any other commands of the application. The commands stay registered
+// when the bot stops, so they do not disappear during a restart. Only the
+// first bridge of a session registers them.
+func (b *Bridge) registerCommands(ctx context.Context, s *discordgo.Session, r *discordgo.Ready) {
+	if !b.leadsSession() {
+		return
+	}
+	appId := r.User.ID
+	existing, err := b.discord.ApplicationCommands(appId, "")
+	if err != nil {
+		b.logger(ctx).Error("Error getting commands", "error", err)
+		return
+	}
+	commands := bridgeCommands()
+	for _, command := range existing {
+		if !isBridgeCommand(command.Name) {
+			commands = append(commands, command)
+		}
+	}
+	_, err = b.discord.ApplicationCommandBulkOverwrite(appId, "", commands)
+	if err != nil {
+		b.logger(ctx).Error("Error registering commands", "error", err)
+	}
+}
+
+type ThreadTask struct {
+	ProjectId int
+	TaskId    int
+	StatusId  int
+	ThreadId  string
+}
+
+// getThreadTask returns the story of a synced thread. It only fails when the
+// database does.
+func (b *Bridge) getThreadTask(threadId string) (ThreadTask, bool, error) {
+	projectId, err := b.getProjectId(threadId)
+	if err != nil {
+		return ThreadTask{}, false, nil
+	}
+	task := ThreadTask{ProjectId: projectId, ThreadId: threadId}
+	var found bool
+	task.TaskId, task.StatusId, found, err = b.getThreadMapping(threadId)
+	return task, found, err
+}
+
+func (b *Bridge) interactionEvent(ctx context.Context, s *discordgo.Session, i *discordgo.InteractionCreate) {
+	ctx = b.withLog(ctx, "thread_id", i.ChannelID)
+	if i.Type != discordgo.InteractionApplicationCommand && i.Type != discordgo.InteractionApplicationCommandAutocomplete {
+		return
+	}
+	if !isBridgeCommand(i.ApplicationCommandData().Name) {
+		// other commands of the application are handled elsewhere
+		return
+	}
+	if !b.answersCommand(i.ChannelID) {
+		// another bridge on the session answers
+		return
+	}
+	switch i.Type {
+	case discordgo.InteractionApplicationCommand:
+		b.runCommand(b.withLog(ctx, "command", i.ApplicationCommandData().Name), i)
+	case discordgo.InteractionApplicationCommandAutocomplete:
+		b.autocompleteCommand(ctx, i)
+	}
+}
+
+type CommandOptions map[string]*discordgo.ApplicationCommandInteractionDataOption
+
+func commandOptions(options []*discordgo.ApplicationCommandInteractionDataOption) CommandOptions {
+	values := make(CommandOptions)
+	for _, option := range options {
+		values[option.Name] = option
+	}
+	return values
+}
+
+func (o CommandOptions) String(name string) string {
+	option, ok := o[name]
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(option.StringValue())
+}
+
+func (b *Bridge) respondEphemeral(ctx context.Context, i *discordgo.InteractionCreate, content string) {
+	err := b.discord.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: content,
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		b.logger(ctx).Error("Error responding to interaction", "error", err)
+	}
+}
+
+func (b *Bridge) runCommand(ctx context.Context, i *discordgo.InteractionCreate) {
+	data := i.ApplicationCommandData()
+	if data.Name == "taiga" {
+		b.runLinkCommand(ctx, i)
+		return
+	}
+	task, ok, err := b.getThreadTask(i.ChannelID)
+	if err != nil {
+		b.logger(ctx).Error("Error getting story", "error", err)
+		b.respondEphemeral(ctx, i, "Could not find the user story of this thread, please try again.")
+		return
+	}
+	if !ok {
+		b.respondEphemeral(ctx, i, "This command can only be used in a thread synced with Taiga.")
+		return
+	}
+	ctx = b.withLog(ctx, "project_id", task.ProjectId, "story_id", task.TaskId)
+	if !b.deferResponse(ctx, i) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+	options := commandOptions(data.Options)
+	var message string
+	switch data.Name {
+	case "status":
+		message, err = b.statusCommand(ctx, task, options, interactionUser(i))
+	case "assign":
+		message, err = b.assignCommand(ctx, task, options, interactionUser(i))
+	case "points":
+		message, err = b.pointsCommand(ctx, task, options)
+	case "due":
+		message, err = b.dueCommand(ctx, task, options)
+	case "tag":
+		message, err = b.tagCommand(ctx, task, data.Options[0].Name, commandOptions(data.Options[0].Options))
+	case "block":
+		message, err = b.blockCommand(ctx, task, options)
+	default:
+		err = errors.New("unknown command " + data.Name)
+	}
+	if err != nil {
+		message = "Could not update the user story: " + err.Error()
+	}
+	b.editResponse(ctx, i, message)
+}
+
+// deferResponse tells Discord an answer only the caller can see is coming,
+// since Taiga can take longer to answer than Discord waits for a response.
+func (b *Bridge) deferResponse(ctx context.Context, i *discordgo.InteractionCreate) bool {
+	err := b.discord.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Flags: discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		b.logger(ctx).Error("Error responding to interaction", "error", err)
+		return false
+	}
+	return true
+}
+
+// editResponse answers an interaction after deferResponse.
+func (b *Bridge) editResponse(ctx context.Context, i *discordgo.InteractionCreate, content string) {
+	_, err := b.discord.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+		Content: &content,
+	})
+	if err != nil {
+		b.logger(ctx).Error("Error responding to interaction", "error", err)
+	}
+}
+
+// resolveStatus accepts the id sent by autocomplete as well as a typed name
+// or slug.
+func (b *Bridge) resolveStatus(projectId int, value string) (Status, bool) {
+	for _, status := range b.statuses.get(projectId) {
+		if strconv.Itoa(status.Id) == value || strings.EqualFold(status.Name, value) || status.Slug == value {
+			return status, true
+		}
+	}
+	return Status{}, false
+}
+
+func (b *Bridge) statusCommand(ctx context.Context, task ThreadTask, options CommandOptions, caller *discordgo.User) (string, error) {
+	status, found := b.resolveStatus(task.ProjectId, options.String("status"))
+	if !found {
+		return "", errors.New("unknown status " + options.String("status"))
+	}
+	// the change is ordered with the jobs of the thread, like a status tag
+	err := b.onThread(ctx, task.ThreadId, func() error {
+		err := b.patchTask(ctx, task.TaskId, map[string]any{"status": status.Id})
+		if err != nil {
+			return err
+		}
+		return b.applyStatusUpdate(ctx, StatusUpdate{
+			TaskId:    task.TaskId,
+			ThreadId:  task.ThreadId,
+			Status:    status,
+			ChangedBy: caller.Mention(),
+		})
+	})
+	if err != nil {
+		return "", err
+	}
+	return "Status changed to \"" + status.Name + "\".", nil
+}
+
+func interactionUser(i *discordgo.InteractionCreate) *discordgo.User {
+	if i.Member != nil {
+		return i.Member.User
+	}
+	return i.User
+}
+
+// assignCommand assigns a project member, or the linked Taiga account of a
+// Discord member. Without either, the caller assigns themselves.
+func (b *Bridge) assignCommand(ctx context.Context, task ThreadTask, options CommandOptions, caller *discordgo.User) (string, error) {
+	value := options.String("member")
+	if value == "" {
+		discordId := caller.ID
+		if option, ok := options["user"]; ok {
+			discordId = option.UserValue(nil).ID
+		}
+		taigaUserId, err := b.linkedTaigaUser(discordId)
+		if err != nil {
+			return "", err
+		}
+		value = strconv.Itoa(taigaUserId)
+	}
+	if value == "0" || strings.EqualFold(value, "nobody") {
+		err := b.patchTask(ctx, task.TaskId, map[string]any{"assigned_to": nil, "assigned_users": []int{}})
+		if err != nil {
+			return "", err
+		}
+		return "The user story is now unassigned.", nil
+	}
+	metadata, err := b.getProjectMetadata(ctx, task.ProjectId)
+	if err != nil {
+		return "", err
+	}
+	for _, member := range metadata.Members {
+		if member.User == nil {
+			continue
+		}
+		if strconv.Itoa(*member.User) == value || strings.EqualFold(member.FullName, value) {
+			err = b.patchTask(ctx, task.TaskId, map[string]any{"assigned_to": *member.User, "assigned_users": []int{*member.User}})
+			if err != nil {
+				return "", err
+			}
+			return "Assigned to " + member.FullName + ".", nil
+		}
+	}
+	return "", errors.New("unknown member " + value)
+}
+
+func (b *Bridge) pointsCommand(ctx context.Context, task ThreadTask, options CommandOptions) (string, error) {
+	metadata, err := b.getProjectMetadata(ctx, task.ProjectId)
+	if err != nil {
+		return "", err
+	}
+	var point *taiga.Point
+	for i, candidate := range metadata.Points {
+		if strconv.Itoa(candidate.Id) == options.String("points") || candidate.Name == options.String("points") {
+			point = &metadata.Points[i]
+		}
+	}
+	if point == nil {
+		return "", errors.New("unknown points " + options.String("points"))
+	}
+	var role *taiga.Role
+	for i, candidate := range metadata.Roles {
+		if !candidate.Computable {
+			continue
+		}
+		value := options.String("role")
+		if value == "" || strconv.Itoa(candidate.Id) == value || strings.EqualFold(candidate.Name, value) {
+			if value == "" && role != nil {
+				return "", errors.New("the project estimates several roles, please choose one")
+			}
+			role = &metadata.Roles[i]
+		}
+	}
+	if role == nil {
+		return "", errors.New("unknown role " + options.String("role"))
+	}
+	err = b.retryOnConflict(ctx, task.TaskId, func(story taiga.UserStory) error {
+		// the other roles keep the points they have now
+		points := make(map[string]int)
+		for roleId, pointId := range story.Points {
+			points[roleId] = pointId
+		}
+		points[strconv.Itoa(role.Id)] = point.Id
+		_, err := b.taiga.PatchUserStory(ctx, task.TaskId, story.Version, map[string]any{"points": points})
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return "Points for " + role.Name + " set to " + point.Name + ".", nil
+}
+
+func (b *Bridge) dueCommand(ctx context.Context, task ThreadTask, options CommandOptions) (string, error) {
+	value := options.String("date")
+	if value == "" || strings.EqualFold(value, "none") {
+		err := b.patchTask(ctx, task.TaskId, map[string]any{"due_date": nil})
+		if err != nil {
+			return "", err
+		}
+		return "Due date removed.", nil
+	}
+	_, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return "", errors.New("the date has to look like 2006-01-02")
+	}
+	err = b.patchTask(ctx, task.TaskId, map[string]any{"due_date": value})
+	if err != nil {
+		return "", err
+	}
+	return "Due date set to " + value + ".", nil
+}
+
+func (b *Bridge) tagCommand(ctx context.Context, task ThreadTask, action string, options CommandOptions) (string, error) {
+	tag := options.String("tag")
+	if tag == "" {
+		return "", errors.New("no tag given")
+	}
+	err := b.retryOnConflict(ctx, task.TaskId, func(story taiga.UserStory) error {
+		_, err := b.taiga.PatchUserStory(ctx, task.TaskId, story.Version, map[string]any{"tags": editTags(story.TagNames(), action, tag)})
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if action == "remove" {
+		return "Removed tag \"" + tag + "\".", nil
+	}
+	return "Added tag \"" + tag + "\".", nil
+}
+
+// editTags adds tag to tags or removes it, ignoring case.
+func editTags(tags []string, action string, tag string) []string {
+	edited := []string{}
+	found := false
+	for _, existing := range tags {
+		if strings.EqualFold(existing, tag) {
+			found = true
+			if action == "remove" {
+				continue
+			}
+		}
+		edited = append(edited, existing)
+	}
+	if action == "add" && !found {
+		edited = append(edited, tag)
+	}
+	return edited
+}
+
+func (b *Bridge) blockCommand(ctx context.Context, task ThreadTask, options CommandOptions) (string, error) {
+	blocked := true
+	if option, ok := options["blocked"]; ok {
+		blocked = option.BoolValue()
+	}
+	reason := options.String("reason")
+	if !blocked {
+		reason = ""
+	}
+	err := b.patchTask(ctx, task.TaskId, map[string]any{"is_blocked": blocked, "blocked_note": reason})
+	if err != nil {
+		return "", err
+	}
+	if !blocked {
+		return "The user story is no longer blocked.", nil
+	}
+	return "The user story is now blocked.", nil
+}
+
+func (b *Bridge) autocompleteCommand(ctx context.Context, i *discordgo.InteractionCreate) {
+	data := i.ApplicationCommandData()
+	options := data.Options
+	subcommand := ""
+	if data.Name == "tag" && len(options) > 0 {
+		subcommand = options[0].Name
+		options = options[0].Options
+	}
+	var focused *discordgo.ApplicationCommandInteractionDataOption
+	for _, option := range options {
+		if option.Focused {
+			focused = option
+		}
+	}
+	task, ok, err := b.getThreadTask(i.ChannelID)
+	if err != nil {
+		b.logger(ctx).Error("Error getting story", "error", err)
+	}
+	var choices []*discordgo.ApplicationCommandOptionChoice
+	if ok && focused != nil {
+		var err error
+		ctx, cancel := context.WithTimeout(ctx, autocompleteTimeout)
+		choices, err = b.commandChoices(ctx, task, data.Name, subcommand, focused.Name)
+		if err != nil {
+			b.logger(ctx).Error("Error loading choices", "error", err)
+		}
+		cancel()
+		choices = filterChoices(choices, focused.StringValue())
+	}
+	err = b.discord.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionApplicationCommandAutocompleteResult,
+		Data: &discordgo.InteractionResponseData{
+			Choices: choices,
+		},
+	})
+	if err != nil {
+		b.logger(ctx).Error("Error responding to autocomplete", "error", err)
+	}
+}
+
+func (b *Bridge) commandChoices(ctx context.Context, task ThreadTask, command string, subcommand string, option string) ([]*discordgo.ApplicationCommandOptionChoice, error) {
+	var choices []*discordgo.ApplicationCommandOptionChoice
+	if command == "status" {
+		for _, status := range b.statuses.get(task.ProjectId) {
+			choices = append(choices, &discordgo.ApplicationCommandOptionChoice{Name: status.Name, Value: strconv.Itoa(status.Id)})
+		}
+		return choices, nil
+	}
+	if command == "tag" && subcommand == "remove" {
+		story, err := b.taiga.GetUserStory(ctx, task.TaskId)
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range story.TagNames() {
+			choices = append(choices, &discordgo.ApplicationCommandOptionChoice{Name: tag, Value: tag})
+		}
+		return choices, nil
+	}
+	metadata, err := b.getProjectMetadata(ctx, task.ProjectId)
+	if err != nil {
+		return nil, err
+	}
+	switch command + "/" + option {
+	case "assign/member":
+		choices = append(choices, &discordgo.ApplicationCommandOptionChoice{Name: "Nobody", Value: "0"})
+		for _, member := range metadata.Members {
+			if member.User != nil {
+				choices = append(choices, &discordgo.ApplicationCommandOptionChoice{Name: member.FullName, Value: strconv.Itoa(*member.User)})
+			}
+		}
+	case "points/points":
+		for _, point := range metadata.Points {
+			choices = append(choices, &discordgo.ApplicationCommandOptionChoice{Name: point.Name, Value: strconv.Itoa(point.Id)})
+		}
+	case "points/role":
+		for _, role := range metadata.Roles {
+			if role.Computable {
+				choices = append(choices, &discordgo.ApplicationCommandOptionChoice{Name: role.Name, Value: strconv.Itoa(role.Id)})
+			}
+		}
+	case "tag/tag":
+		for _, tag := range metadata.Tags {
+			choices = append(choices, &discordgo.ApplicationCommandOptionChoice{Name: tag, Value: tag})
+		}
+	}
+	return choices, nil
+}
+
+func filterChoices(choices []*discordgo.ApplicationCommandOptionChoice, typed string) []*discordgo.ApplicationCommandOptionChoice {
+	typed = strings.ToLower(strings.TrimSpace(typed))
+	filtered := []*discordgo.ApplicationCommandOptionChoice{}
+	for _, choice := range choices {
+		if len(filtered) == autocompleteLimit {
+			break
+		}
+		if strings.Contains(strings.ToLower(choice.Name), typed) {
+			choice.Name = truncate(choice.Name, 100)
+			filtered = append(filtered, choice)
+		}
+	}
+	return filtered
+}
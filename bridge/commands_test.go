@@ -0,0 +1,222 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"taiga-discord/taiga"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestIsBridgeCommand(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"status", true},
+		{"tag", true},
+		{"taiga", true},
+		{"ping", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := isBridgeCommand(test.name); got != test.want {
+			t.Errorf("isBridgeCommand(%q) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// The commands apply their change to the story as it is after a concurrent
+// edit, instead of overwriting the edit.
+func TestCommandsKeepConcurrentEdits(t *testing.T) {
+	tests := []struct {
+		name     string
+		conflict func(story *taiga.UserStory)
+		run      func(b *Bridge, task ThreadTask) (string, error)
+		field    string
+		want     any
+	}{
+		{
+			name:     "add tag",
+			conflict: func(story *taiga.UserStory) { story.Tags = json.RawMessage(`["ui"]`) },
+			run: func(b *Bridge, task ThreadTask) (string, error) {
+				return b.tagCommand(context.Background(), task, "add", testOptions("tag", "bug"))
+			},
+			field: "tags",
+			want:  []string{"ui", "bug"},
+		},
+		{
+			name:     "remove tag",
+			conflict: func(story *taiga.UserStory) { story.Tags = json.RawMessage(`["ui","bug"]`) },
+			run: func(b *Bridge, task ThreadTask) (string, error) {
+				return b.tagCommand(context.Background(), task, "remove", testOptions("tag", "BUG"))
+			},
+			field: "tags",
+			want:  []string{"ui"},
+		},
+		{
+			name:     "points",
+			conflict: func(story *taiga.UserStory) { story.Points = map[string]int{"2": 11} },
+			run: func(b *Bridge, task ThreadTask) (string, error) {
+				return b.pointsCommand(context.Background(), task, testOptions("points", "3", "role", "UX"))
+			},
+			field: "points",
+			want:  map[string]int{"1": 13, "2": 11},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := &fakeTaiga{
+				stories:   map[int]taiga.UserStory{7: {Id: 7, Version: 1, Tags: json.RawMessage(`["bug"]`)}},
+				conflicts: []func(story *taiga.UserStory){test.conflict},
+			}
+			b := newTestBridge(t, fake)
+			b.metadataCache[1] = ProjectMetadata{
+				FetchedAt: time.Now(),
+				Points:    []taiga.Point{{Id: 13, Name: "3"}},
+				Roles:     []taiga.Role{{Id: 1, Name: "UX", Computable: true}, {Id: 2, Name: "Back", Computable: true}},
+			}
+			_, err := test.run(b, ThreadTask{ProjectId: 1, TaskId: 7, ThreadId: "thread"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(fake.patches) != 1 {
+				t.Fatalf("%d patches, want 1", len(fake.patches))
+			}
+			if got := fake.patches[0][test.field]; !reflect.DeepEqual(got, test.want) {
+				t.Errorf("patched %s to %v, want %v", test.field, got, test.want)
+			}
+		})
+	}
+}
+
+// testOptions builds command options from name and value pairs.
+func testOptions(pairs ...string) CommandOptions {
+	options := make(CommandOptions)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		options[pairs[i]] = &discordgo.ApplicationCommandInteractionDataOption{
+			Name:  pairs[i],
+			Type:  discordgo.ApplicationCommandOptionString,
+			Value: pairs[i+1],
+		}
+	}
+	return options
+}
+
+// Bridges sharing a session answer every command once.
+func TestAnswersCommand(t *testing.T) {
+	first := newTestBridge(t, &fakeTaiga{}, ProjectConfig{Id: 1, ChannelId: "forum1"})
+	second := newTestBridge(t, &fakeTaiga{}, ProjectConfig{Id: 2, ChannelId: "forum2"})
+	second.discord = first.discord
+	err := first.state().GuildAdd(&discordgo.Guild{
+		ID: "10",
+		Channels: []*discordgo.Channel{
+			{ID: "forum1", GuildID: "10"},
+			{ID: "forum2", GuildID: "10"},
+			{ID: "general", GuildID: "10"},
+		},
+		Threads: []*discordgo.Channel{
+			{ID: "thread1", GuildID: "10", ParentID: "forum1"},
+			{ID: "thread2", GuildID: "10", ParentID: "forum2"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	startedBridgesLock.Lock()
+	startedBridges[first.discord] = []*Bridge{first, second}
+	startedBridgesLock.Unlock()
+	t.Cleanup(func() {
+		startedBridgesLock.Lock()
+		delete(startedBridges, first.discord)
+		startedBridgesLock.Unlock()
+	})
+	tests := []struct {
+		channelId string
+		want      *Bridge
+	}{
+		{"thread1", first},
+		{"thread2", second},
+		{"general", first},
+	}
+	for _, test := range tests {
+		for _, b := range []*Bridge{first, second} {
+			if got := b.answersCommand(test.channelId); got != (b == test.want) {
+				t.Errorf("bridge of %s answers in %s: %v, want %v", b.config.Projects[0].ChannelId, test.channelId, got, b == test.want)
+			}
+		}
+	}
+}
+
+func TestRegisterCommandsKeepsOtherCommands(t *testing.T) {
+	b := newTestBridge(t, &fakeTaiga{})
+	discord := &fakeDiscord{commands: []*discordgo.ApplicationCommand{
+		{ID: "1", Name: "ping"},
+		{ID: "2", Name: "status", Description: "outdated"},
+	}}
+	b.discord = discord
+	b.registerCommands(context.Background(), nil, &discordgo.Ready{User: &discordgo.User{ID: "app"}})
+	var names []string
+	for _, command := range discord.commands {
+		names = append(names, command.Name)
+		if command.Name == "status" && command.Description == "outdated" {
+			t.Error("the status command was not updated")
+		}
+	}
+	want := []string{"status", "assign", "points", "due", "tag", "block", "taiga", "ping"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("registered %v, want %v", names, want)
+	}
+}
+
+func TestGetThreadTask(t *testing.T) {
+	tests := []struct {
+		name      string
+		threadId  string
+		dropTable bool
+		wantFound bool
+		wantErr   bool
+	}{
+		{name: "synced thread", threadId: "thread", wantFound: true},
+		{name: "thread that is not synced", threadId: "new"},
+		{name: "thread of another forum", threadId: "elsewhere"},
+		{name: "database error", threadId: "thread", dropTable: true, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newTestBridge(t, &fakeTaiga{})
+			err := b.state().GuildAdd(&discordgo.Guild{
+				ID: "10",
+				Threads: []*discordgo.Channel{
+					{ID: "thread", GuildID: "10", ParentID: "forum"},
+					{ID: "new", GuildID: "10", ParentID: "forum"},
+					{ID: "elsewhere", GuildID: "10", ParentID: "other"},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = b.db.Exec("INSERT INTO tasks (thread_id, task_id, status_id, message_id) VALUES ('thread', 7, 1, 'thread')")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.dropTable {
+				_, err = b.db.Exec("DROP TABLE tasks")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			task, found, err := b.getThreadTask(test.threadId)
+			if found != test.wantFound || (err != nil) != test.wantErr {
+				t.Fatalf("got %v and error %v, want %v and error %v", found, err, test.wantFound, test.wantErr)
+			}
+			if found && (task.TaskId != 7 || task.ProjectId != 1) {
+				t.Errorf("got %+v, want story 7 of project 1", task)
+			}
+		})
+	}
+}
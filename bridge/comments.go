@@ -0,0 +1,255 @@
+package bridge
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"taiga-discord/taiga"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const discordMessageLimit = 2000
+
+// Every comment the bridge adds to Taiga ends with a marker naming the Discord
+// message it belongs to. The marker is a markdown link definition, which Taiga
+// does not show, and lets the bridge find its comment in the story's history
+// even when others comment at the same time.
+var commentMarkerPattern = regexp.MustCompile(`\[//\]: # \(discord:(\d+)\)\s*$`)
+
+func commentMarker(messageId string) string {
+	return "\n\n[//]: # (discord:" + messageId + ")"
+}
+
+// commentHeader starts the comments added before the templates.
+func commentHeader(user string) string {
+	return "Comment from " + user + ": \n\n"
+}
+
+// markedMessage returns the id of the message in the marker of a comment, or
+// "" when it has none.
+func markedMessage(comment string) string {
+	match := commentMarkerPattern.FindStringSubmatch(comment)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// findComment finds the comment the bot added to a story for a message.
+func (b *Bridge) findComment(ctx context.Context, taskId int, messageId string) (string, bool, error) {
+	history, err := b.taiga.GetUserStoryHistory(ctx, taskId)
+	if err != nil {
+		return "", false, err
+	}
+	botUserId := b.getBotUserId(ctx)
+	for _, entry := range history {
+		if entry.User.Pk == botUserId && entry.DeleteCommentDate == nil && markedMessage(entry.Comment) == messageId {
+			return entry.Id, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// matchesMessage reports whether a comment without a marker was added for
+// message, by comparing its text. Those comments are older than the markdown
+// conversion and only had their user mentions translated.
+func (b *Bridge) matchesMessage(comment string, message *discordgo.Message) (bool, error) {
+	author, err := b.authorName(message.Author)
+	if err != nil {
+		return false, err
+	}
+	content, err := b.translateMentions(message.Content, message.Mentions)
+	if err != nil {
+		return false, err
+	}
+	text := commentHeader(author) + content
+	return strings.HasPrefix(strings.TrimSpace(comment), strings.TrimSpace(text)), nil
+}
+
+type MirroredComment struct {
+	MessageId string
+	UpdatedAt int64
+}
+
+// checkComments mirrors Taiga comments when running in polling mode. Only the
+// stories whose modified date moved since their comments were last synced are
+// checked, modified holds the dates seen by this poll. A new comment moves the
+// modified date, edited and deleted comments are picked up with the next change
+// of the story.
+func (b *Bridge) checkComments(ctx context.Context, modified map[int]string) {
+	row, err := b.db.Query("SELECT task_id, thread_id FROM tasks")
+	if err != nil {
+		b.logger(ctx).Error("Error getting threads", "error", err)
+		return
+	}
+	threads := make(map[int]string)
+	for row.Next() {
+		var taskId int
+		var threadId string
+		err = row.Scan(&taskId, &threadId)
+		if err != nil {
+			row.Close()
+			b.logger(ctx).Error("Error getting threads", "error", err)
+			return
+		}
+		threads[taskId] = threadId
+	}
+	row.Close()
+	for taskId, threadId := range threads {
+		date, seen := modified[taskId]
+		if !seen || date == b.commentsSynced[taskId] {
+			continue
+		}
+		err = b.onThread(ctx, threadId, func() error {
+			return b.syncTaigaComments(ctx, taskId, threadId)
+		})
+		if err != nil {
+			b.logger(ctx).Error("Error syncing comments", "story_id", taskId, "thread_id", threadId, "error", err)
+			continue
+		}
+		b.commentsSynced[taskId] = date
+	}
+}
+
+// syncTaigaComments posts comments written in Taiga into the story's thread
+// and applies edits and deletions to the messages posted earlier. Comments
+// made by the bot account came from Discord and are skipped, as are comments
+// written before the story was synced.
+func (b *Bridge) syncTaigaComments(ctx context.Context, taskId int, threadId string) error {
+	history, err := b.taiga.GetUserStoryHistory(ctx, taskId)
+	if err != nil {
+		return err
+	}
+	var since int64
+	err = b.db.QueryRow("SELECT COALESCE(comments_since, 0) FROM tasks WHERE task_id = ?", taskId).Scan(&since)
+	if err != nil {
+		return err
+	}
+	row, err := b.db.Query("SELECT comment_id, message_id, updated_at FROM comments WHERE task_id = ?", taskId)
+	if err != nil {
+		return err
+	}
+	mirrored := make(map[string]MirroredComment)
+	for row.Next() {
+		var commentId string
+		var comment MirroredComment
+		var updatedAt any
+		err = row.Scan(&commentId, &comment.MessageId, &updatedAt)
+		if err != nil {
+			row.Close()
+			return err
+		}
+		// comments edited from Discord store a timestamp rather than milliseconds
+		if millis, ok := updatedAt.(int64); ok {
+			comment.UpdatedAt = millis
+		}
+		mirrored[commentId] = comment
+	}
+	row.Close()
+	botUserId := b.getBotUserId(ctx)
+	for i := len(history) - 1; i >= 0; i-- {
+		entry := history[i]
+		if entry.User.Pk == botUserId {
+			continue
+		}
+		comment, exists := mirrored[entry.Id]
+		if entry.DeleteCommentDate != nil {
+			if !exists {
+				continue
+			}
+			// the row goes first so the delete event does not touch Taiga again
+			_, err = b.db.Exec("DELETE FROM comments WHERE comment_id = ?", entry.Id)
+			if err != nil {
+				return err
+			}
+			if comment.MessageId == "" {
+				continue
+			}
+			err = b.discord.ChannelMessageDelete(threadId, comment.MessageId)
+			if err != nil && !isDiscordNotFound(err) {
+				return err
+			}
+			continue
+		}
+		if entry.Comment == "" {
+			continue
+		}
+		updatedAt := parseTaigaTime(entry.CreatedAt)
+		if entry.EditCommentDate != nil {
+			updatedAt = parseTaigaTime(*entry.EditCommentDate)
+		}
+		if !exists {
+			if parseTaigaTime(entry.CreatedAt) < since {
+				continue
+			}
+			message, err := b.discord.ChannelMessageSendComplex(threadId, &discordgo.MessageSend{
+				Content:         formatTaigaComment(entry),
+				AllowedMentions: &discordgo.MessageAllowedMentions{},
+			})
+			if err != nil {
+				return err
+			}
+			_, err = b.db.Exec("INSERT INTO comments (message_id, comment_id, task_id, updated_at) VALUES (?, ?, ?, ?)", message.ID, entry.Id, taskId, updatedAt)
+			if err != nil {
+				return err
+			}
+			b.metrics.add(metricCommentsSynced, labels("direction", toDiscord), 1)
+		} else if updatedAt > comment.UpdatedAt && comment.MessageId != "" {
+			content := formatTaigaComment(entry)
+			_, err = b.discord.ChannelMessageEditComplex(&discordgo.MessageEdit{
+				ID:              comment.MessageId,
+				Channel:         threadId,
+				Content:         &content,
+				AllowedMentions: &discordgo.MessageAllowedMentions{},
+			})
+			if isDiscordNotFound(err) {
+				// the message was deleted while the bot did not see it
+				err = b.forgetCommentMessage(entry.Id)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			_, err = b.db.Exec("UPDATE comments SET updated_at = ? WHERE comment_id = ?", updatedAt, entry.Id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func formatTaigaComment(entry taiga.HistoryEntry) string {
+	name := entry.User.Name
+	if name == "" {
+		name = entry.User.Username
+	}
+	return truncate("**"+name+"** commented in Taiga:\n\n"+entry.Comment, discordMessageLimit)
+}
+
+func truncate(value string, limit int) string {
+	runes := []rune(value)
+	if len(runes) <= limit {
+		return value
+	}
+	return string(runes[:limit-3]) + "..."
+}
+
+// parseTaigaTime converts a Taiga timestamp to unix milliseconds, the format
+// used for updated_at in the comments table.
+func parseTaigaTime(value string) int64 {
+	parsed, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		parsed, err = time.Parse("2006-01-02T15:04:05.999999-0700", value)
+	}
+	if err != nil {
+		return 0
+	}
+	return parsed.UnixMilli()
+}
@@ -0,0 +1,127 @@
+package bridge
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"taiga-discord/taiga"
+)
+
+func TestCheckCommentsOnlyFetchesModifiedStories(t *testing.T) {
+	fake := &fakeTaiga{}
+	b := newTestBridge(t, fake)
+	_, err := b.db.Exec("INSERT INTO tasks (thread_id, task_id, status_id, message_id) VALUES ('a', 7, 1, 'a'), ('b', 8, 1, 'b'), ('c', 9, 1, 'c')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	polls := []struct {
+		modified map[int]string
+		want     []int
+	}{
+		// the first poll checks every story it saw
+		{map[int]string{7: "1", 8: "1"}, []int{7, 8}},
+		{map[int]string{7: "1", 8: "1"}, nil},
+		{map[int]string{7: "1", 8: "2", 9: "1"}, []int{8, 9}},
+		{map[int]string{}, nil},
+	}
+	for i, poll := range polls {
+		fake.historyCalls = nil
+		b.checkComments(context.Background(), poll.modified)
+		slices.Sort(fake.historyCalls)
+		if !slices.Equal(fake.historyCalls, poll.want) {
+			t.Errorf("poll %d fetched the history of %v, want %v", i, fake.historyCalls, poll.want)
+		}
+	}
+}
+
+func TestCommentMarker(t *testing.T) {
+	tests := []struct {
+		name    string
+		comment string
+		want    string
+	}{
+		{"round trip", "Comment from ann: \n\nHello" + commentMarker("123456789"), "123456789"},
+		{"empty content", commentMarker("42"), "42"},
+		{"trailing whitespace from Taiga", "Hello" + commentMarker("42") + "\n", "42"},
+		{"marker quoted in the text", "See [//]: # (discord:1) below\n\nHello" + commentMarker("2"), "2"},
+		{"marker not at the end", "Hello" + commentMarker("42") + "\n\nedited in Taiga", ""},
+		{"no marker", "Comment from ann: \n\nHello", ""},
+		{"not a message id", "Hello\n\n[//]: # (discord:abc)", ""},
+	}
+	for _, test := range tests {
+		if got := markedMessage(test.comment); got != test.want {
+			t.Errorf("%s: markedMessage = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFindComment(t *testing.T) {
+	deleted := "2026-01-02T00:00:00Z"
+	fake := &fakeTaiga{
+		userId: 1,
+		history: map[int][]taiga.HistoryEntry{7: {
+			{Id: "by someone", Comment: "copied" + commentMarker("101"), User: taiga.HistoryUser{Pk: 5}},
+			{Id: "deleted", Comment: "old" + commentMarker("101"), User: taiga.HistoryUser{Pk: 1}, DeleteCommentDate: &deleted},
+			{Id: "other message", Comment: "other" + commentMarker("102"), User: taiga.HistoryUser{Pk: 1}},
+			{Id: "bot", Comment: "mine" + commentMarker("101"), User: taiga.HistoryUser{Pk: 1}},
+		}},
+	}
+	b := newTestBridge(t, fake)
+	commentId, found, err := b.findComment(context.Background(), 7, "101")
+	if err != nil || !found || commentId != "bot" {
+		t.Errorf("found %q (%v, %v), want the bot's comment", commentId, found, err)
+	}
+}
+
+// Comments written in Taiga before a story was synced are not posted into
+// its thread.
+func TestSyncTaigaCommentsSkipsOlderComments(t *testing.T) {
+	fake := &fakeTaiga{
+		userId: 1,
+		history: map[int][]taiga.HistoryEntry{7: {
+			{Id: "old", Comment: "Written long ago", CreatedAt: "2020-01-02T00:00:00Z", User: taiga.HistoryUser{Pk: 5}},
+			{Id: "bot", Comment: "From Discord" + commentMarker("101"), CreatedAt: "2030-01-02T00:00:00Z", User: taiga.HistoryUser{Pk: 1}},
+		}},
+	}
+	b := newTestBridge(t, fake)
+	_, err := b.db.Exec("INSERT INTO tasks (thread_id, task_id, status_id, message_id, comments_since) VALUES ('thread', 7, 1, 'thread', ?)", parseTaigaTime("2026-01-01T00:00:00Z"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// posting a comment would fail without a Discord connection
+	err = b.syncTaigaComments(context.Background(), 7, "thread")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	err = b.db.QueryRow("SELECT COUNT(*) FROM comments").Scan(&count)
+	if err != nil || count != 0 {
+		t.Errorf("mirrored %d comments (%v), want none", count, err)
+	}
+}
+
+// Edits of a comment whose copy in Discord was deleted are not applied to the
+// missing message.
+func TestSyncTaigaCommentsSkipsDeletedCopies(t *testing.T) {
+	edited := "2026-03-01T00:00:00Z"
+	fake := &fakeTaiga{
+		userId: 1,
+		history: map[int][]taiga.HistoryEntry{7: {
+			{Id: "c1", Comment: "Edited", CreatedAt: "2026-02-01T00:00:00Z", EditCommentDate: &edited, User: taiga.HistoryUser{Pk: 5}},
+		}},
+	}
+	b := newTestBridge(t, fake)
+	_, err := b.db.Exec("INSERT INTO tasks (thread_id, task_id, status_id, message_id, comments_since) VALUES ('thread', 7, 1, 'thread', 0)")
+	if err == nil {
+		_, err = b.db.Exec("INSERT INTO comments (message_id, comment_id, task_id, updated_at) VALUES ('', 'c1', 7, 0)")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	// editing the message would fail without a Discord connection
+	err = b.syncTaigaComments(context.Background(), 7, "thread")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,132 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"taiga-discord/taiga"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const deletedStarterNotice = "The Discord message this user story was created from has been deleted."
+
+type DeleteMessageJob struct {
+	ProjectId int
+	MessageId string
+}
+
+func (b *Bridge) deleteMessageEvent(ctx context.Context, s *discordgo.Session, m *discordgo.MessageDelete) {
+	projectId, err := b.getProjectId(m.ChannelID)
+	if err != nil {
+		return
+	}
+	b.enqueueJob(ctx, m.ChannelID, "delete_message", DeleteMessageJob{ProjectId: projectId, MessageId: m.ID})
+}
+
+func (b *Bridge) deleteMessagesEvent(ctx context.Context, s *discordgo.Session, m *discordgo.MessageDeleteBulk) {
+	projectId, err := b.getProjectId(m.ChannelID)
+	if err != nil {
+		return
+	}
+	for _, messageId := range m.Messages {
+		b.enqueueJob(ctx, m.ChannelID, "delete_message", DeleteMessageJob{ProjectId: projectId, MessageId: messageId})
+	}
+}
+
+// runDeleteMessageJob removes what a deleted message created in Taiga: its
+// comment, or the description when it started the thread, and the files it
+// uploaded. The bot's copies of comments written in Taiga are not messages
+// from Discord, deleting one leaves the comment alone and only forgets the
+// message.
+func (b *Bridge) runDeleteMessageJob(ctx context.Context, job DeleteMessageJob) error {
+	row, err := b.db.Query("SELECT task_id FROM tasks WHERE message_id = ?", job.MessageId)
+	if err != nil {
+		return err
+	}
+	if row.Next() {
+		var taskId int
+		err = row.Scan(&taskId)
+		row.Close()
+		if err != nil {
+			return err
+		}
+		err = b.retryOnConflict(ctx, taskId, func(story taiga.UserStory) error {
+			if strings.HasPrefix(story.Description, deletedStarterNotice) {
+				return nil
+			}
+			// the description may have been edited in Taiga since, so it is kept
+			_, err := b.taiga.PatchUserStory(ctx, taskId, story.Version, map[string]any{"description": deletedStarterNotice + "\n\n" + story.Description})
+			return err
+		})
+		if err != nil && !errors.Is(err, taiga.ErrNotFound) {
+			return err
+		}
+		return b.deleteUnusedAttachments(ctx, nil, taskId, job.MessageId)
+	}
+	row.Close()
+	row, err = b.db.Query("SELECT comment_id, task_id FROM comments WHERE message_id = ?", job.MessageId)
+	if err != nil {
+		return err
+	}
+	if !row.Next() {
+		row.Close()
+		return nil
+	}
+	var commentId string
+	var taskId int
+	err = row.Scan(&commentId, &taskId)
+	row.Close()
+	if err != nil {
+		return err
+	}
+	mirror, err := b.isMirroredComment(ctx, taskId, commentId)
+	if err != nil {
+		return err
+	}
+	if mirror {
+		return b.forgetCommentMessage(commentId)
+	}
+	err = b.taiga.DeleteComment(ctx, taskId, commentId)
+	if err != nil && !errors.Is(err, taiga.ErrNotFound) {
+		return fmt.Errorf("deleting comment %s: %w", commentId, err)
+	}
+	err = b.deleteUnusedAttachments(ctx, nil, taskId, job.MessageId)
+	if err != nil {
+		return err
+	}
+	_, err = b.db.Exec("DELETE FROM comments WHERE message_id = ?", job.MessageId)
+	return err
+}
+
+// forgetCommentMessage keeps the row of a comment written in Taiga whose
+// message is gone, with an empty message_id, so the comment is neither posted
+// again nor are its edits applied to the missing message.
+func (b *Bridge) forgetCommentMessage(commentId string) error {
+	_, err := b.db.Exec("UPDATE comments SET message_id = '' WHERE comment_id = ?", commentId)
+	return err
+}
+
+// isMirroredComment reports whether a comment was written in Taiga by someone
+// else than the bot, so its message in Discord is the bot's copy.
+func (b *Bridge) isMirroredComment(ctx context.Context, taskId int, commentId string) (bool, error) {
+	botUserId, err := b.taiga.UserID(ctx)
+	if err != nil {
+		return false, err
+	}
+	history, err := b.taiga.GetUserStoryHistory(ctx, taskId)
+	if errors.Is(err, taiga.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range history {
+		if entry.Id == commentId {
+			return entry.User.Pk != botUserId, nil
+		}
+	}
+	return false, nil
+}
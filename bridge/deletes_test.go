@@ -0,0 +1,72 @@
+package bridge
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"taiga-discord/taiga"
+)
+
+func TestDeleteStarterMessageKeepsDescription(t *testing.T) {
+	fake := &fakeTaiga{stories: map[int]taiga.UserStory{7: {Id: 7, Version: 1, Description: "Edited in Taiga"}}}
+	b := newTestBridge(t, fake)
+	_, err := b.db.Exec("INSERT INTO tasks (thread_id, task_id, status_id, message_id) VALUES ('thread', 7, 1, 'starter')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// deleting it twice must not add the notice twice
+	for range 2 {
+		err = b.runDeleteMessageJob(context.Background(), DeleteMessageJob{ProjectId: 1, MessageId: "starter"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := deletedStarterNotice + "\n\nEdited in Taiga"
+	if len(fake.patches) != 1 || fake.patches[0]["description"] != want {
+		t.Errorf("patches %v, want the description %q", fake.patches, want)
+	}
+}
+
+func TestDeleteMessageOfComment(t *testing.T) {
+	const botUserId = 1
+	tests := []struct {
+		name        string
+		author      int
+		wantDeleted []string
+		// wantRow is whether the comment is still known
+		wantRow bool
+	}{
+		{name: "message from Discord", author: botUserId, wantDeleted: []string{"c1"}},
+		{name: "bot's copy of a Taiga comment", author: 5, wantRow: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := &fakeTaiga{
+				userId:  botUserId,
+				history: map[int][]taiga.HistoryEntry{7: {{Id: "c1", Comment: "Hello", User: taiga.HistoryUser{Pk: test.author}}}},
+			}
+			b := newTestBridge(t, fake)
+			_, err := b.db.Exec("INSERT INTO comments (message_id, comment_id, task_id, updated_at) VALUES ('m1', 'c1', 7, 0)")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = b.runDeleteMessageJob(context.Background(), DeleteMessageJob{ProjectId: 1, MessageId: "m1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(fake.deletedComments, test.wantDeleted) {
+				t.Errorf("deleted comments %v, want %v", fake.deletedComments, test.wantDeleted)
+			}
+			var count int
+			var messageId string
+			err = b.db.QueryRow("SELECT COUNT(*), COALESCE(MAX(message_id), '') FROM comments WHERE comment_id = 'c1'").Scan(&count, &messageId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (count == 1) != test.wantRow || messageId != "" {
+				t.Errorf("%d rows for the comment, with message %q, want a row without message: %v", count, messageId, test.wantRow)
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Import brings over what existed before the bridge: forum threads that are
+// not synced become stories with their messages as comments, and stories that
+// have no thread become forum posts. The imports table remembers threads that
+// were started but not finished, so an interrupted import picks up where it
+// stopped when it is run again.
+
+const (
+	ImportThread = "thread"
+	ImportStory  = "story"
+
+	defaultImportDelay = 500 * time.Millisecond
+)
+
+type ImportOptions struct {
+	// DryRun only reports what would be imported.
+	DryRun bool
+	// Stories also creates forum posts for stories without a thread. Stories
+	// in a closed status are skipped unless Closed is set.
+	Stories bool
+	Closed  bool
+	// Delay is the pause before every write to Taiga or Discord
+	// ( Default: 500ms ).
+	Delay time.Duration
+	// Report is called for every thread and story as it is imported.
+	Report func(ImportItem)
+}
+
+type ImportItem struct {
+	Kind     string `json:"kind"`
+	ThreadId string `json:"thread_id,omitempty"`
+	TaskId   int    `json:"task_id,omitempty"`
+	Name     string `json:"name"`
+	Comments int    `json:"comments"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Import creates stories for the threads of every project that are not
+// synced, and threads for its stories when options.Stories is set.
+func (b *Bridge) Import(ctx context.Context, options ImportOptions) error {
+	if !b.statuses.loaded() {
+		err := b.load(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	if options.Delay <= 0 {
+		options.Delay = defaultImportDelay
+	}
+	if options.Report == nil {
+		options.Report = func(ImportItem) {}
+	}
+	// the session is not necessarily open, so the bot is looked up
+	bot, err := b.discord.User("@me")
+	if err != nil {
+		return err
+	}
+	for _, project := range b.config.Projects {
+		err = b.importThreads(ctx, project, bot.ID, options)
+		if err != nil {
+			return err
+		}
+		if options.Stories {
+			err = b.importStories(ctx, project.Id, options)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *Bridge) importThreads(ctx context.Context, project ProjectConfig, botId string, options ImportOptions) error {
+	threads, err := b.forumThreads(project.ChannelId)
+	if err != nil {
+		return err
+	}
+	for _, thread := range threads {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		pending, err := b.needsImport(thread.ID)
+		if err != nil {
+			return err
+		}
+		if !pending {
+			continue
+		}
+		item := ImportItem{Kind: ImportThread, ThreadId: thread.ID, Name: thread.Name}
+		threadCtx := b.withCorrelation(ctx, "", "event", "import", "project_id", project.Id, "thread_id", thread.ID)
+		err = b.importThread(threadCtx, project.Id, thread, botId, options, &item)
+		if errors.Is(err, errSkipImport) {
+			continue
+		}
+		if err != nil {
+			item.Error = err.Error()
+		}
+		options.Report(item)
+	}
+	return nil
+}
+
+var errSkipImport = errors.New("skipped")
+
+func (b *Bridge) importThread(ctx context.Context, projectId int, thread *discordgo.Channel, botId string, options ImportOptions, item *ImportItem) error {
+	starter, err := b.discord.ChannelMessage(thread.ID, thread.ID)
+	if err != nil {
+		return err
+	}
+	if starter.Author == nil || starter.Author.ID == botId {
+		// a published story that is no longer synced
+		return errSkipImport
+	}
+	// the first message shares its id with the thread and is never a comment
+	messages, err := b.threadMessagesAfter(thread.ID, snowflake(thread.ID))
+	if err != nil {
+		return err
+	}
+	var comments []*discordgo.Message
+	for _, message := range messages {
+		if message.Author == nil || message.Author.ID == botId {
+			continue
+		}
+		if message.Type != discordgo.MessageTypeDefault && message.Type != discordgo.MessageTypeReply {
+			continue
+		}
+		comments = append(comments, message)
+	}
+	item.Comments = len(comments)
+	if options.DryRun {
+		return nil
+	}
+
+	_, err = b.db.Exec("INSERT INTO imports (thread_id, started_at) VALUES (?, ?) ON CONFLICT(thread_id) DO NOTHING", thread.ID, time.Now().UnixMilli())
+	if err != nil {
+		return err
+	}
+	// keep the status the thread is tagged with, or close the story of an
+	// archived thread
+	statusId := 0
+	if status, _, found := b.appliedStatus(projectId, thread.AppliedTags, 0); found {
+		statusId = status.Id
+	} else if thread.ThreadMetadata != nil && thread.ThreadMetadata.Archived {
+		if status, found := b.archiveStatus(projectId); found {
+			statusId = status.Id
+		}
+	}
+	job := CreateTaskJob{
+		ProjectId:   projectId,
+		ThreadName:  thread.Name,
+		AppliedTags: thread.AppliedTags,
+		Message:     starter,
+		StatusId:    statusId,
+	}
+	err = b.paced(ctx, options.Delay, func(ctx context.Context) error {
+		return b.runCreateTaskJob(ctx, thread.ID, job)
+	})
+	if err != nil {
+		return err
+	}
+	item.TaskId, _, _, err = b.getThreadMapping(thread.ID)
+	if err != nil {
+		return err
+	}
+	for _, message := range comments {
+		err = b.paced(ctx, options.Delay, func(ctx context.Context) error {
+			return b.createComment(ctx, projectId, thread.ID, message)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	err = b.markSynced(thread.ParentID, thread.ID)
+	if err != nil {
+		return err
+	}
+	err = b.markSynced(thread.ID, thread.LastMessageID)
+	if err != nil {
+		return err
+	}
+	_, err = b.db.Exec("UPDATE imports SET finished_at = ? WHERE thread_id = ?", time.Now().UnixMilli(), thread.ID)
+	return err
+}
+
+// needsImport reports whether a thread is not synced yet, or its import was
+// interrupted.
+func (b *Bridge) needsImport(threadId string) (bool, error) {
+	_, _, mapped, err := b.getThreadMapping(threadId)
+	if err != nil {
+		return false, err
+	}
+	if !mapped {
+		return true, nil
+	}
+	var unfinished int
+	err = b.db.QueryRow("SELECT COUNT(*) FROM imports WHERE thread_id = ? AND finished_at IS NULL", threadId).Scan(&unfinished)
+	return unfinished > 0, err
+}
+
+// forumThreads returns every active and archived thread of a forum channel,
+// oldest first.
+func (b *Bridge) forumThreads(channelId string) ([]*discordgo.Channel, error) {
+	channel, err := b.discord.Channel(channelId)
+	if err != nil {
+		return nil, err
+	}
+	active, err := b.discord.GuildThreadsActive(channel.GuildID)
+	if err != nil {
+		return nil, err
+	}
+	threads := active.Threads
+	var before *time.Time
+	for {
+		archived, err := b.discord.ThreadsArchived(channelId, before, 100)
+		if err != nil {
+			return nil, err
+		}
+		threads = append(threads, archived.Threads...)
+		if !archived.HasMore || len(archived.Threads) == 0 {
+			break
+		}
+		last := archived.Threads[len(archived.Threads)-1]
+		if last.ThreadMetadata == nil {
+			break
+		}
+		archiveTimestamp := last.ThreadMetadata.ArchiveTimestamp
+		before = &archiveTimestamp
+	}
+	var forumThreads []*discordgo.Channel
+	for _, thread := range threads {
+		if thread.ParentID == channelId {
+			forumThreads = append(forumThreads, thread)
+		}
+	}
+	sort.Slice(forumThreads, func(i, j int) bool {
+		return snowflake(forumThreads[i].ID) < snowflake(forumThreads[j].ID)
+	})
+	return forumThreads, nil
+}
+
+func (b *Bridge) importStories(ctx context.Context, projectId int, options ImportOptions) error {
+	metadata, err := b.getProjectMetadata(ctx, projectId)
+	if err != nil {
+		return err
+	}
+	for _, status := range b.statuses.get(projectId) {
+		if status.IsClosed && !options.Closed {
+			continue
+		}
+		stories, err := b.taiga.ListUserStories(ctx, projectId, status.Id)
+		if err != nil {
+			return err
+		}
+		// the story on top of the column is posted last, so it is on top of
+		// the forum too
+		for i := len(stories) - 1; i >= 0; i-- {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			story := stories[i]
+			var mapped int
+			err = b.db.QueryRow("SELECT COUNT(*) FROM tasks WHERE task_id = ?", story.Id).Scan(&mapped)
+			if err != nil {
+				return err
+			}
+			if mapped > 0 {
+				continue
+			}
+			item := ImportItem{Kind: ImportStory, TaskId: story.Id, Name: story.Subject}
+			if !options.DryRun {
+				published := PublishedStory{
+					Id:          story.Id,
+					Ref:         story.Ref,
+					Subject:     story.Subject,
+					Description: story.Description,
+					Permalink:   b.storyLink(metadata.Slug, story.Ref),
+					Tags:        story.Tags,
+					Status:      WebhookStatus{Id: status.Id, Name: status.Name, Slug: status.Slug, IsClosed: status.IsClosed},
+				}
+				err = b.paced(ctx, options.Delay, func(ctx context.Context) error {
+					threadId, err := b.publishStory(projectId, published)
+					item.ThreadId = threadId
+					return err
+				})
+				if err != nil {
+					item.Error = err.Error()
+				}
+			}
+			options.Report(item)
+		}
+	}
+	return nil
+}
+
+// paced waits delay before a write and retries it like the outbox does while
+// Taiga or Discord are rate limiting or unavailable.
+func (b *Bridge) paced(ctx context.Context, delay time.Duration, write func(ctx context.Context) error) error {
+	for attempts := 1; ; attempts++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		writeCtx, cancel := context.WithTimeout(ctx, jobTimeout)
+		err := write(writeCtx)
+		cancel()
+		if err == nil || !isRetryable(err) || attempts >= b.maxJobAttempts() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retryDelay(err, attempts)):
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"taiga-discord/taiga"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Archiving a thread closes its story, unarchiving it or posting in it
+// reopens the story, and deleting it is handled by the project's
+// ThreadDelete policy.
+
+const (
+	deletePolicyArchive = "archive"
+	deletePolicyTag     = "tag"
+	deletePolicyDelete  = "delete"
+
+	deletedThreadTag = "discord-deleted"
+)
+
+type ThreadJob struct {
+	ProjectId int
+}
+
+func archiveChangeKey(threadId string, archived bool) string {
+	return threadId + ":" + strconv.FormatBool(archived)
+}
+
+// editArchived changes the archived state of a thread, together with the
+// rest of the edit.
+func (b *Bridge) editArchived(thread *discordgo.Channel, edit *discordgo.ChannelEdit) error {
+	if edit.Archived != nil && thread.ThreadMetadata != nil && thread.ThreadMetadata.Archived != *edit.Archived {
+		b.archiveChangesLock.Lock()
+		b.archiveChanges[archiveChangeKey(thread.ID, *edit.Archived)]++
+		b.archiveChangesLock.Unlock()
+		thread.ThreadMetadata.Archived = *edit.Archived
+	}
+	_, err := b.discord.ChannelEdit(thread.ID, edit)
+	return err
+}
+
+func (b *Bridge) isBotArchiveChange(threadId string, archived bool) bool {
+	b.archiveChangesLock.Lock()
+	defer b.archiveChangesLock.Unlock()
+	key := archiveChangeKey(threadId, archived)
+	if b.archiveChanges[key] == 0 {
+		return false
+	}
+	b.archiveChanges[key]--
+	if b.archiveChanges[key] == 0 {
+		delete(b.archiveChanges, key)
+	}
+	return true
+}
+
+// autoArchived reports whether Discord archived the thread because nobody
+// posted in it for its auto archive duration.
+func autoArchived(thread *discordgo.Channel) bool {
+	lastActivity := thread.ID
+	if thread.LastMessageID != "" {
+		lastActivity = thread.LastMessageID
+	}
+	timestamp, err := discordgo.SnowflakeTimestamp(lastActivity)
+	if err != nil {
+		return false
+	}
+	idle := time.Duration(thread.ThreadMetadata.AutoArchiveDuration) * time.Minute
+	return idle > 0 && time.Since(timestamp) >= idle-time.Minute
+}
+
+func (b *Bridge) threadArchiveEvent(ctx context.Context, s *discordgo.Session, t *discordgo.ThreadUpdate) {
+	if t.ThreadMetadata == nil {
+		return
+	}
+	archived := t.ThreadMetadata.Archived
+	if t.BeforeUpdate != nil && t.BeforeUpdate.ThreadMetadata != nil && t.BeforeUpdate.ThreadMetadata.Archived == archived {
+		return
+	}
+	if b.isBotArchiveChange(t.ID, archived) {
+		return
+	}
+	projectId, exists := b.channelProjects[t.ParentID]
+	if !exists {
+		return
+	}
+	if !archived {
+		b.enqueueJob(ctx, t.ID, "reopen_task", ThreadJob{ProjectId: projectId})
+	} else if !autoArchived(t.Channel) {
+		b.enqueueJob(ctx, t.ID, "close_task", ThreadJob{ProjectId: projectId})
+	}
+}
+
+func (b *Bridge) threadDeleteEvent(ctx context.Context, s *discordgo.Session, t *discordgo.ThreadDelete) {
+	projectId, exists := b.channelProjects[t.ParentID]
+	if !exists {
+		return
+	}
+	b.enqueueJob(ctx, t.ID, "delete_thread", ThreadJob{ProjectId: projectId})
+}
+
+// archiveStatus is the status a story is moved to when its thread is
+// archived: the project's ArchiveStatus, or the first closed status.
+func (b *Bridge) archiveStatus(projectId int) (Status, bool) {
+	slug := b.project(projectId).ArchiveStatus
+	for _, status := range b.statuses.get(projectId) {
+		if (slug == "" && status.IsClosed) || (slug != "" && status.Slug == slug) {
+			return status, true
+		}
+	}
+	return Status{}, false
+}
+
+// reopenStatus is the status a story is moved to when its thread is
+// unarchived: the project's ReopenStatus, or the default status.
+func (b *Bridge) reopenStatus(projectId int) (Status, bool) {
+	slug := b.project(projectId).ReopenStatus
+	if slug == "" {
+		return b.findStatus(projectId, b.statuses.defaultStatus(projectId))
+	}
+	return b.statuses.findBySlug(projectId, slug)
+}
+
+// checkThreadDelete checks the delete policy of a project.
+func checkThreadDelete(project ProjectConfig) error {
+	switch project.ThreadDelete {
+	case "", deletePolicyArchive, deletePolicyTag, deletePolicyDelete:
+		return nil
+	}
+	return errors.New("unknown thread delete policy " + project.ThreadDelete)
+}
+
+func (b *Bridge) threadDeletePolicy(projectId int) string {
+	policy := b.project(projectId).ThreadDelete
+	if policy == "" {
+		return deletePolicyArchive
+	}
+	return policy
+}
+
+// runLifecycleJob moves the story of a thread to the archive status when
+// closing and to the reopen status when reopening, unless it already is
+// closed or open.
+func (b *Bridge) runLifecycleJob(ctx context.Context, threadId string, job ThreadJob, closing bool) error {
+	_, statusId, found, err := b.getThreadMapping(threadId)
+	if err != nil || !found {
+		return err
+	}
+	current, found := b.findStatus(job.ProjectId, statusId)
+	if found && current.IsClosed == closing {
+		return nil
+	}
+	var status Status
+	if closing {
+		status, found = b.archiveStatus(job.ProjectId)
+	} else {
+		status, found = b.reopenStatus(job.ProjectId)
+	}
+	if !found {
+		return fmt.Errorf("%w: no status configured to move the story to", errInvalidJob)
+	}
+	return b.runUpdateStatusJob(ctx, threadId, UpdateStatusJob{ProjectId: job.ProjectId, StatusId: status.Id})
+}
+
+// runDeleteThreadJob applies the delete policy to the story of a deleted
+// thread and forgets the thread.
+func (b *Bridge) runDeleteThreadJob(ctx context.Context, threadId string, job ThreadJob) error {
+	taskId, _, found, err := b.getThreadMapping(threadId)
+	if err != nil || !found {
+		return err
+	}
+	switch policy := b.threadDeletePolicy(job.ProjectId); policy {
+	case deletePolicyArchive:
+		status, found := b.archiveStatus(job.ProjectId)
+		if !found {
+			return fmt.Errorf("%w: no closed status to archive the story in", errInvalidJob)
+		}
+		err = b.updateTaskStatus(ctx, taskId, status.Id)
+	case deletePolicyTag:
+		err = b.retryOnConflict(ctx, taskId, func(story taiga.UserStory) error {
+			tags := story.TagNames()
+			if slices.Contains(tags, deletedThreadTag) {
+				return nil
+			}
+			_, err := b.taiga.PatchUserStory(ctx, taskId, story.Version, map[string]any{"tags": append(tags, deletedThreadTag)})
+			return err
+		})
+	case deletePolicyDelete:
+		err = b.taiga.DeleteUserStory(ctx, taskId)
+	default:
+		return fmt.Errorf("%w: unknown thread delete policy %s", errInvalidJob, policy)
+	}
+	if err != nil && !errors.Is(err, taiga.ErrNotFound) {
+		return err
+	}
+	_, err = b.db.Exec("DELETE FROM comments WHERE task_id = ?", taskId)
+	if err != nil {
+		return err
+	}
+	_, err = b.db.Exec("DELETE FROM uploads WHERE task_id = ?", taskId)
+	if err != nil {
+		return err
+	}
+	_, err = b.db.Exec("DELETE FROM tasks WHERE thread_id = ?", threadId)
+	return err
+}
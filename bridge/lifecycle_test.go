@@ -0,0 +1,73 @@
+package bridge
+
+import (
+	"context"
+	"testing"
+
+	"taiga-discord/taiga"
+)
+
+var testStatuses = []taiga.Status{
+	{Id: 1, Name: "New", Slug: "new"},
+	{Id: 2, Name: "In progress", Slug: "in-progress"},
+	{Id: 3, Name: "Done", Slug: "done", IsClosed: true},
+	{Id: 4, Name: "Archived", Slug: "archived", IsClosed: true},
+}
+
+func TestLifecycleStatuses(t *testing.T) {
+	tests := []struct {
+		name        string
+		project     ProjectConfig
+		wantLoadErr bool
+		wantArchive int
+		wantReopen  int
+	}{
+		{name: "defaults", wantArchive: 3, wantReopen: 1},
+		{name: "configured", project: ProjectConfig{ArchiveStatus: "archived", ReopenStatus: "in-progress"}, wantArchive: 4, wantReopen: 2},
+		{name: "unknown archive status", project: ProjectConfig{ArchiveStatus: "closed"}, wantLoadErr: true},
+		{name: "unknown reopen status", project: ProjectConfig{ReopenStatus: "open"}, wantLoadErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			project := test.project
+			project.Id = 1
+			project.ChannelId = "forum"
+			b := newTestBridge(t, &fakeTaiga{statuses: testStatuses}, project)
+			err := b.setupStatuses(context.Background(), 1)
+			if test.wantLoadErr {
+				if err == nil {
+					t.Fatal("loading the statuses succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status, found := b.archiveStatus(1); !found || status.Id != test.wantArchive {
+				t.Errorf("archive status %d (found %v), want %d", status.Id, found, test.wantArchive)
+			}
+			if status, found := b.reopenStatus(1); !found || status.Id != test.wantReopen {
+				t.Errorf("reopen status %d (found %v), want %d", status.Id, found, test.wantReopen)
+			}
+		})
+	}
+}
+
+func TestCheckThreadDelete(t *testing.T) {
+	tests := []struct {
+		policy  string
+		wantErr bool
+	}{
+		{"", false},
+		{deletePolicyArchive, false},
+		{deletePolicyTag, false},
+		{deletePolicyDelete, false},
+		{"remove", true},
+	}
+	for _, test := range tests {
+		err := checkThreadDelete(ProjectConfig{ThreadDelete: test.policy})
+		if (err != nil) != test.wantErr {
+			t.Errorf("policy %q: got error %v, want error %v", test.policy, err, test.wantErr)
+		}
+	}
+}
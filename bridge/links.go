@@ -0,0 +1,295 @@
+package bridge
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"taiga-discord/taiga"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+type UserLink struct {
+	DiscordId     string
+	TaigaUserId   int
+	TaigaUsername string
+}
+
+var linkCommand = &discordgo.ApplicationCommand{
+	Name:         "taiga",
+	Description:  "Link your Discord account to your Taiga account",
+	DMPermission: &dmPermission,
+	Options: []*discordgo.ApplicationCommandOption{
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "link",
+			Description: "Start linking your Taiga account",
+			Options: []*discordgo.ApplicationCommandOption{
+				{Type: discordgo.ApplicationCommandOptionString, Name: "username", Description: "Your Taiga username", Required: true},
+			},
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "verify",
+			Description: "Finish linking once the code is in your Taiga bio",
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "unlink",
+			Description: "Remove the link to your Taiga account",
+		},
+		{
+			Type:        discordgo.ApplicationCommandOptionSubCommand,
+			Name:        "approve",
+			Description: "Link a member to a Taiga account without verification ( Manage Server only )",
+			Options: []*discordgo.ApplicationCommandOption{
+				{Type: discordgo.ApplicationCommandOptionUser, Name: "user", Description: "Discord member", Required: true},
+				{Type: discordgo.ApplicationCommandOptionString, Name: "username", Description: "Taiga username", Required: true},
+			},
+		},
+	},
+}
+
+// getUserLink returns the verified Taiga account of a Discord user.
+func (b *Bridge) getUserLink(discordId string) (UserLink, bool, error) {
+	link := UserLink{DiscordId: discordId}
+	err := b.db.QueryRow("SELECT taiga_user_id, taiga_username FROM user_links WHERE discord_id = ? AND verified = 1", discordId).Scan(&link.TaigaUserId, &link.TaigaUsername)
+	if errors.Is(err, sql.ErrNoRows) {
+		return UserLink{}, false, nil
+	}
+	if err != nil {
+		return UserLink{}, false, err
+	}
+	return link, true, nil
+}
+
+// authorName is the name used for a Discord user in Taiga: the linked Taiga
+// username, so Taiga shows a mention, or the Discord display name.
+func (b *Bridge) authorName(user *discordgo.User) (string, error) {
+	link, ok, err := b.getUserLink(user.ID)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return "@" + link.TaigaUsername, nil
+	}
+	if user.GlobalName != "" {
+		return user.GlobalName, nil
+	}
+	return user.Username, nil
+}
+
+var userMention = regexp.MustCompile(`<@!?(\d+)>`)
+
+// translateMentions replaces Discord user mentions with the names used in
+// Taiga, the only conversion comments had before taigaMarkdown.
+func (b *Bridge) translateMentions(content string, mentions []*discordgo.User) (string, error) {
+	var err error
+	translated := userMention.ReplaceAllStringFunc(content, func(mention string) string {
+		id := userMention.FindStringSubmatch(mention)[1]
+		for _, user := range mentions {
+			if user.ID == id {
+				name, nameErr := b.authorName(user)
+				err = cmp.Or(err, nameErr)
+				return name
+			}
+		}
+		link, ok, linkErr := b.getUserLink(id)
+		err = cmp.Or(err, linkErr)
+		if ok {
+			return "@" + link.TaigaUsername
+		}
+		return mention
+	})
+	return translated, err
+}
+
+// watchTask adds the linked Taiga account of a Discord user to the watchers
+// of a story.
+func (b *Bridge) watchTask(ctx context.Context, taskId int, user *discordgo.User) {
+	link, ok, err := b.getUserLink(user.ID)
+	if err != nil {
+		b.logger(ctx).Error("Error getting linked account", "story_id", taskId, "error", err)
+		return
+	}
+	if !ok {
+		return
+	}
+	err = b.retryOnConflict(ctx, taskId, func(story taiga.UserStory) error {
+		if slices.Contains(story.Watchers, link.TaigaUserId) {
+			return nil
+		}
+		_, err := b.taiga.PatchUserStory(ctx, taskId, story.Version, map[string]any{"watchers": append(story.Watchers, link.TaigaUserId)})
+		return err
+	})
+	if err != nil {
+		b.logger(ctx).Error("Error adding watcher", "story_id", taskId, "error", err)
+	}
+}
+
+func (b *Bridge) getTaigaUser(ctx context.Context, username string) (taiga.User, error) {
+	user, err := b.taiga.GetUserByUsername(ctx, username)
+	if errors.Is(err, taiga.ErrNotFound) {
+		return user, errors.New("there is no Taiga user called " + username)
+	}
+	return user, err
+}
+
+func linkCode() (string, error) {
+	code := make([]byte, 4)
+	_, err := rand.Read(code)
+	if err != nil {
+		return "", err
+	}
+	return "discord-" + hex.EncodeToString(code), nil
+}
+
+func (b *Bridge) runLinkCommand(ctx context.Context, i *discordgo.InteractionCreate) {
+	data := i.ApplicationCommandData()
+	subcommand := data.Options[0]
+	options := commandOptions(subcommand.Options)
+	if i.Member == nil || i.Member.User == nil {
+		b.respondEphemeral(ctx, i, "This command can only be used in a server.")
+		return
+	}
+	if subcommand.Name == "approve" && i.Member.Permissions&discordgo.PermissionManageServer == 0 {
+		b.respondEphemeral(ctx, i, "Only members with the Manage Server permission can approve links.")
+		return
+	}
+	if !b.deferResponse(ctx, i) {
+		return
+	}
+	discordId := i.Member.User.ID
+	ctx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+	var message string
+	var err error
+	switch subcommand.Name {
+	case "link":
+		message, err = b.startLink(ctx, discordId, options.String("username"))
+	case "verify":
+		message, err = b.verifyLink(ctx, discordId)
+	case "unlink":
+		_, err = b.db.Exec("DELETE FROM user_links WHERE discord_id = ?", discordId)
+		message = "Your Taiga account is no longer linked."
+	case "approve":
+		message, err = b.approveLink(ctx, options["user"].UserValue(nil).ID, options.String("username"))
+	}
+	if err != nil {
+		message = "Could not link the account: " + err.Error()
+	}
+	b.editResponse(ctx, i, message)
+}
+
+func (b *Bridge) startLink(ctx context.Context, discordId string, username string) (string, error) {
+	user, err := b.getTaigaUser(ctx, username)
+	if err != nil {
+		return "", err
+	}
+	err = b.checkTaigaUserFree(discordId, user)
+	if err != nil {
+		return "", err
+	}
+	code, err := linkCode()
+	if err != nil {
+		return "", err
+	}
+	// a verified link stays until it is unlinked
+	result, err := b.db.Exec("INSERT INTO user_links (discord_id, taiga_user_id, taiga_username, code, verified, created_at) VALUES (?, ?, ?, ?, 0, ?) ON CONFLICT (discord_id) DO UPDATE SET taiga_user_id = excluded.taiga_user_id, taiga_username = excluded.taiga_username, code = excluded.code, created_at = excluded.created_at WHERE verified = 0", discordId, user.Id, user.Username, code, time.Now().Unix())
+	if err != nil {
+		return "", err
+	}
+	changed, err := result.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+	if changed == 0 {
+		return "", errors.New("your account is already linked, run `/taiga unlink` first")
+	}
+	return "Add `" + code + "` to the bio of your Taiga profile, then run `/taiga verify`. An admin can also approve the link with `/taiga approve`.", nil
+}
+
+func (b *Bridge) verifyLink(ctx context.Context, discordId string) (string, error) {
+	row, err := b.db.Query("SELECT taiga_username, code FROM user_links WHERE discord_id = ? AND verified = 0", discordId)
+	if err != nil {
+		return "", err
+	}
+	if !row.Next() {
+		row.Close()
+		return "", errors.New("start with `/taiga link` first")
+	}
+	var username string
+	var code string
+	err = row.Scan(&username, &code)
+	row.Close()
+	if err != nil {
+		return "", err
+	}
+	user, err := b.getTaigaUser(ctx, username)
+	if err != nil {
+		return "", err
+	}
+	if !strings.Contains(user.Bio, code) {
+		return "", errors.New("the code `" + code + "` is not in the bio of " + username)
+	}
+	err = b.checkTaigaUserFree(discordId, user)
+	if err != nil {
+		return "", err
+	}
+	_, err = b.db.Exec("UPDATE user_links SET verified = 1, code = NULL, taiga_user_id = ? WHERE discord_id = ?", user.Id, discordId)
+	if err != nil {
+		return "", err
+	}
+	return "Linked to Taiga user " + user.Username + ". You can remove the code from your bio now.", nil
+}
+
+func (b *Bridge) approveLink(ctx context.Context, discordId string, username string) (string, error) {
+	user, err := b.getTaigaUser(ctx, username)
+	if err != nil {
+		return "", err
+	}
+	err = b.checkTaigaUserFree(discordId, user)
+	if err != nil {
+		return "", err
+	}
+	_, err = b.db.Exec("INSERT OR REPLACE INTO user_links (discord_id, taiga_user_id, taiga_username, code, verified, created_at) VALUES (?, ?, ?, NULL, 1, ?)", discordId, user.Id, user.Username, time.Now().Unix())
+	if err != nil {
+		return "", err
+	}
+	return "<@" + discordId + "> is now linked to Taiga user " + user.Username + ".", nil
+}
+
+// checkTaigaUserFree fails when the Taiga account is verified for another
+// Discord user.
+func (b *Bridge) checkTaigaUserFree(discordId string, user taiga.User) error {
+	var other string
+	err := b.db.QueryRow("SELECT discord_id FROM user_links WHERE taiga_user_id = ? AND verified = 1 AND discord_id != ?", user.Id, discordId).Scan(&other)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return errors.New("Taiga user " + user.Username + " is already linked to <@" + other + ">")
+}
+
+// linkedTaigaUser resolves the Taiga account for /assign when a Discord
+// member is given instead of a project member.
+func (b *Bridge) linkedTaigaUser(discordId string) (int, error) {
+	link, ok, err := b.getUserLink(discordId)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, errors.New("<@" + discordId + "> has not linked a Taiga account")
+	}
+	return link.TaigaUserId, nil
+}
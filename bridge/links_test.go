@@ -0,0 +1,142 @@
+package bridge
+
+import (
+	"context"
+	"testing"
+
+	"taiga-discord/taiga"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestLinks(t *testing.T) {
+	users := []taiga.User{{Id: 5, Username: "ann", Bio: "discord-code"}, {Id: 6, Username: "ben"}}
+	tests := []struct {
+		name string
+		// existing rows: discord id, Taiga user id, code, verified
+		links    [][4]any
+		run      func(b *Bridge) (string, error)
+		wantErr  bool
+		wantLink map[string]int
+	}{
+		{
+			name: "start",
+			run:  func(b *Bridge) (string, error) { return b.startLink(context.Background(), "1", "ann") },
+		},
+		{
+			name:     "restart replaces a pending link",
+			links:    [][4]any{{"1", 6, "discord-old", 0}},
+			run:      func(b *Bridge) (string, error) { return b.startLink(context.Background(), "1", "ann") },
+			wantLink: map[string]int{},
+		},
+		{
+			name:     "start keeps a verified link",
+			links:    [][4]any{{"1", 6, nil, 1}},
+			run:      func(b *Bridge) (string, error) { return b.startLink(context.Background(), "1", "ann") },
+			wantErr:  true,
+			wantLink: map[string]int{"1": 6},
+		},
+		{
+			name:     "start with an account linked to someone else",
+			links:    [][4]any{{"2", 5, nil, 1}},
+			run:      func(b *Bridge) (string, error) { return b.startLink(context.Background(), "1", "ann") },
+			wantErr:  true,
+			wantLink: map[string]int{"2": 5},
+		},
+		{
+			name:     "verify",
+			links:    [][4]any{{"1", 5, "discord-code", 0}},
+			run:      func(b *Bridge) (string, error) { return b.verifyLink(context.Background(), "1") },
+			wantLink: map[string]int{"1": 5},
+		},
+		{
+			name:     "verify an account linked to someone else since",
+			links:    [][4]any{{"1", 5, "discord-code", 0}, {"2", 5, nil, 1}},
+			run:      func(b *Bridge) (string, error) { return b.verifyLink(context.Background(), "1") },
+			wantErr:  true,
+			wantLink: map[string]int{"2": 5},
+		},
+		{
+			name:     "approve an account linked to someone else",
+			links:    [][4]any{{"2", 5, nil, 1}},
+			run:      func(b *Bridge) (string, error) { return b.approveLink(context.Background(), "1", "ann") },
+			wantErr:  true,
+			wantLink: map[string]int{"2": 5},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newTestBridge(t, &fakeTaiga{users: users})
+			for _, link := range test.links {
+				username := "ben"
+				if link[1] == 5 {
+					username = "ann"
+				}
+				_, err := b.db.Exec("INSERT INTO user_links (discord_id, taiga_user_id, taiga_username, code, verified, created_at) VALUES (?, ?, ?, ?, ?, 0)", link[0], link[1], username, link[2], link[3])
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err := test.run(b)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+			for _, discordId := range []string{"1", "2"} {
+				link, found, err := b.getUserLink(discordId)
+				if err != nil {
+					t.Fatal(err)
+				}
+				wantId, wantFound := test.wantLink[discordId]
+				if found != wantFound || link.TaigaUserId != wantId {
+					t.Errorf("user %s is linked to %d (%v), want %d (%v)", discordId, link.TaigaUserId, found, wantId, wantFound)
+				}
+			}
+		})
+	}
+}
+
+func TestUserLinkDatabaseErrors(t *testing.T) {
+	message := &discordgo.Message{
+		ID:        "3",
+		ChannelID: "4",
+		Content:   "Ask <@2>",
+		Author:    &discordgo.User{ID: "1", Username: "bob"},
+	}
+	tests := []struct {
+		name string
+		run  func(b *Bridge) error
+	}{
+		{"author name", func(b *Bridge) error {
+			_, err := b.authorName(message.Author)
+			return err
+		}},
+		{"mentions", func(b *Bridge) error {
+			_, err := b.translateMentions(message.Content, nil)
+			return err
+		}},
+		{"markdown", func(b *Bridge) error {
+			_, err := b.taigaMarkdown(message)
+			return err
+		}},
+		{"message data", func(b *Bridge) error {
+			_, err := b.messageData(1, message.ChannelID, message, nil)
+			return err
+		}},
+		{"matches message", func(b *Bridge) error {
+			_, err := b.matchesMessage("**bob** wrote:\n\nAsk <@2>", message)
+			return err
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newTestBridge(t, &fakeTaiga{})
+			_, err := b.db.Exec("DROP TABLE user_links")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := test.run(b); err == nil {
+				t.Error("got no error for a missing user_links table")
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package bridge
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"runtime/debug"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Everything the bridge does for one Discord event, webhook or polling round
+// is logged with the same correlation_id, including the outbox jobs it queues
+// and their requests to Taiga. The logger travels in the context.
+
+type loggerKey struct{}
+type correlationKey struct{}
+
+func newCorrelationId() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// withCorrelation starts a new unit of work on ctx, logged with a new
+// correlation id or the given one.
+func (b *Bridge) withCorrelation(ctx context.Context, correlationId string, args ...any) context.Context {
+	if correlationId == "" {
+		correlationId = newCorrelationId()
+	}
+	ctx = context.WithValue(ctx, correlationKey{}, correlationId)
+	logger := b.log.With(append([]any{"correlation_id", correlationId}, args...)...)
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// withLog adds attributes to the logger of ctx, like the ids of the thread and
+// story being worked on.
+func (b *Bridge) withLog(ctx context.Context, args ...any) context.Context {
+	return context.WithValue(ctx, loggerKey{}, b.logger(ctx).With(args...))
+}
+
+// logger returns the logger of ctx, or the bridge's when ctx has none.
+func (b *Bridge) logger(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return b.log
+}
+
+func correlationId(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// detach keeps the logger and correlation id of from on ctx, for work that
+// outlives the event that started it.
+func detach(ctx context.Context, from context.Context) context.Context {
+	if id, ok := from.Value(correlationKey{}).(string); ok {
+		ctx = context.WithValue(ctx, correlationKey{}, id)
+	}
+	if logger, ok := from.Value(loggerKey{}).(*slog.Logger); ok {
+		ctx = context.WithValue(ctx, loggerKey{}, logger)
+	}
+	return ctx
+}
+
+// handle wraps a Discord event handler so every event is queued behind the
+// earlier events of its thread, logged with its own correlation id and waited
+// for by Shutdown, and a panic while handling it is logged instead of crashing
+// the bot.
+func handle[T any](b *Bridge, event string, handler func(ctx context.Context, s *discordgo.Session, e T)) func(*discordgo.Session, T) {
+	return func(s *discordgo.Session, e T) {
+		if !b.acceptEvent() {
+			return
+		}
+		b.events.add(eventThread(e), func() {
+			defer b.handlers.Done()
+			ctx := b.withCorrelation(context.Background(), "", "event", event)
+			defer b.recoverPanic(ctx)
+			handler(ctx, s, e)
+		})
+	}
+}
+
+func (b *Bridge) recoverPanic(ctx context.Context) {
+	if r := recover(); r != nil {
+		b.logger(ctx).Error("Panic", "panic", r, "stack", string(debug.Stack()))
+	}
+}
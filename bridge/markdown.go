@@ -0,0 +1,169 @@
+package bridge
+
+import (
+	"cmp"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Messages are converted to the markdown Taiga renders before they become
+// descriptions and comments: mentions of users, channels and roles get
+// readable names, custom emojis become images, timestamps become dates and
+// the markdown only Discord knows is rewritten. Code and links are left as
+// they are, and so is underlined text, which Taiga shows bold.
+
+var (
+	verbatimPattern = regexp.MustCompile("(?s)```.*?```|`[^`\n]+`|https?://[^\\s<>()]+")
+	discordPattern  = regexp.MustCompile(`<@!?(\d+)>|<@&(\d+)>|<#(\d+)>|<(a?):(\w+):(\d+)>|<t:(-?\d+)(?::([tTdDfFR]))?>|\|\|(.+?)\|\|`)
+	subtextPattern  = regexp.MustCompile(`(?m)^-# (.+)$`)
+)
+
+var timestampLayouts = map[string]string{
+	"t": "15:04",
+	"T": "15:04:05",
+	"d": "2006-01-02",
+	"D": "2 January 2006",
+	"f": "2 January 2006 15:04",
+	"F": "Monday, 2 January 2006 15:04",
+	// a relative time would be wrong by the time it is read
+	"R": "2 January 2006 15:04",
+}
+
+// taigaMarkdown converts the content of a message to Taiga markdown. It only
+// fails when the linked accounts of mentioned users can not be looked up.
+func (b *Bridge) taigaMarkdown(message *discordgo.Message) (string, error) {
+	content := quoteRest(message.Content)
+	var converted strings.Builder
+	var err error
+	last := 0
+	for _, verbatim := range verbatimPattern.FindAllStringIndex(content, -1) {
+		converted.WriteString(b.convertText(message, content[last:verbatim[0]], &err))
+		converted.WriteString(content[verbatim[0]:verbatim[1]])
+		last = verbatim[1]
+	}
+	converted.WriteString(b.convertText(message, content[last:], &err))
+	return converted.String(), err
+}
+
+// convertText converts text outside of code and links, keeping the first error
+// in err.
+func (b *Bridge) convertText(message *discordgo.Message, text string, err *error) string {
+	text = subtextPattern.ReplaceAllString(text, "*$1*")
+	return discordPattern.ReplaceAllStringFunc(text, func(token string) string {
+		match := discordPattern.FindStringSubmatch(token)
+		switch {
+		case match[1] != "":
+			name, nameErr := b.userName(message, match[1])
+			*err = cmp.Or(*err, nameErr)
+			return name
+		case match[2] != "":
+			return b.roleName(message, match[2])
+		case match[3] != "":
+			return b.channelLink(match[3])
+		case match[6] != "":
+			extension := ".png"
+			if match[4] == "a" {
+				extension = ".gif"
+			}
+			return "![:" + match[5] + ":](https://cdn.discordapp.com/emojis/" + match[6] + extension + "?size=24)"
+		case match[7] != "":
+			return formatTimestamp(match[7], match[8])
+		case match[9] != "":
+			return "(spoiler: " + b.convertText(message, match[9], err) + ")"
+		}
+		return token
+	})
+}
+
+// quoteRest turns a ">>> " quote, which runs to the end of the message, into a
+// quote of every line.
+func quoteRest(content string) string {
+	start := strings.Index(content, ">>> ")
+	if start < 0 || (start > 0 && content[start-1] != '\n') {
+		return content
+	}
+	lines := strings.Split(content[start+4:], "\n")
+	for i, line := range lines {
+		lines[i] = "> " + line
+	}
+	return content[:start] + strings.Join(lines, "\n")
+}
+
+func formatTimestamp(seconds string, style string) string {
+	unix, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		return seconds
+	}
+	if style == "" {
+		style = "f"
+	}
+	return time.Unix(unix, 0).UTC().Format(timestampLayouts[style]) + " UTC"
+}
+
+// userName is the name of a mentioned user in Taiga, a mention of the linked
+// Taiga account when there is one.
+func (b *Bridge) userName(message *discordgo.Message, userId string) (string, error) {
+	for _, user := range message.Mentions {
+		if user.ID == userId {
+			return b.authorName(user)
+		}
+	}
+	link, ok, err := b.getUserLink(userId)
+	if err != nil || !ok {
+		return "unknown user", err
+	}
+	return "@" + link.TaigaUsername, nil
+}
+
+func (b *Bridge) roleName(message *discordgo.Message, roleId string) string {
+	guildId := message.GuildID
+	if guildId == "" {
+		// messages fetched from the API do not carry the guild
+		channel, err := b.channel(message.ChannelID)
+		if err != nil {
+			return "@deleted-role"
+		}
+		guildId = channel.GuildID
+	}
+	if state := b.state(); state != nil {
+		role, err := state.Role(guildId, roleId)
+		if err == nil {
+			return "@" + role.Name
+		}
+	}
+	roles, err := b.discord.GuildRoles(guildId)
+	if err != nil {
+		return "@deleted-role"
+	}
+	for _, role := range roles {
+		if role.ID == roleId {
+			return "@" + role.Name
+		}
+	}
+	return "@deleted-role"
+}
+
+// channelLink links a mentioned channel or thread in Discord.
+func (b *Bridge) channelLink(channelId string) string {
+	channel, err := b.channel(channelId)
+	if err != nil {
+		return "#unknown-channel"
+	}
+	return "[#" + channel.Name + "](" + discordLink(channel.GuildID, channel.ID, "") + ")"
+}
+
+// channel returns a channel from the state, or from the API when the state
+// does not have it.
+func (b *Bridge) channel(channelId string) (*discordgo.Channel, error) {
+	if state := b.state(); state != nil {
+		channel, err := state.Channel(channelId)
+		if err == nil {
+			return channel, nil
+		}
+	}
+	return b.discord.Channel(channelId)
+}
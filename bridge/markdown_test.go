@@ -0,0 +1,61 @@
+package bridge
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestTaigaMarkdown(t *testing.T) {
+	b := newTestBridge(t, &fakeTaiga{})
+	err := b.state().GuildAdd(&discordgo.Guild{
+		ID:       "10",
+		Roles:    []*discordgo.Role{{ID: "20", Name: "devs"}},
+		Channels: []*discordgo.Channel{{ID: "30", GuildID: "10", Name: "general"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.db.Exec("INSERT INTO user_links (discord_id, taiga_user_id, taiga_username, verified) VALUES ('41', 5, 'ann', 1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mentions := []*discordgo.User{{ID: "40", Username: "bob", GlobalName: "Bob"}}
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"plain", "Hello **world**", "Hello **world**"},
+		{"mentioned user", "Ask <@40>", "Ask Bob"},
+		{"nickname mention", "Ask <@!40>", "Ask Bob"},
+		{"linked user", "Ask <@41>", "Ask @ann"},
+		{"unknown user", "Ask <@42>", "Ask unknown user"},
+		{"role", "Ping <@&20>", "Ping @devs"},
+		{"channel", "See <#30>", "See [#general](https://discord.com/channels/10/30)"},
+		{"emoji", "<:party:50>", "![:party:](https://cdn.discordapp.com/emojis/50.png?size=24)"},
+		{"animated emoji", "<a:party:50>", "![:party:](https://cdn.discordapp.com/emojis/50.gif?size=24)"},
+		{"timestamp", "Due <t:0:d>", "Due 1970-01-01 UTC"},
+		{"default timestamp", "At <t:86400>", "At 2 January 1970 00:00 UTC"},
+		{"relative timestamp", "At <t:86400:R>", "At 2 January 1970 00:00 UTC"},
+		{"spoiler", "It was ||<@40>||", "It was (spoiler: Bob)"},
+		{"underline", "__important__", "__important__"},
+		{"subtext", "-# small print", "*small print*"},
+		{"quote rest", "Look:\n>>> one\ntwo", "Look:\n> one\n> two"},
+		{"code span", "Run `<@40> ||x||`", "Run `<@40> ||x||`"},
+		{"code block", "```\n<@40>\n||x||\n```", "```\n<@40>\n||x||\n```"},
+		{"link", "https://example.com/__init__ and ||x||", "https://example.com/__init__ and (spoiler: x)"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message := &discordgo.Message{Content: test.content, GuildID: "10", ChannelID: "30", Mentions: mentions}
+			got, err := b.taigaMarkdown(message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("taigaMarkdown(%q) = %q, want %q", test.content, got, test.want)
+			}
+		})
+	}
+}
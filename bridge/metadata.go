@@ -0,0 +1,93 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"taiga-discord/taiga"
+)
+
+// maxVersionRetries is how often a change is applied to a freshly fetched
+// story before a version conflict is given up on.
+const maxVersionRetries = 3
+
+// patchTask changes the given fields of a user story, sending the version the
+// story currently has.
+func (b *Bridge) patchTask(ctx context.Context, taskId int, fields map[string]any) error {
+	return b.retryOnConflict(ctx, taskId, func(story taiga.UserStory) error {
+		_, err := b.taiga.PatchUserStory(ctx, taskId, story.Version, fields)
+		return err
+	})
+}
+
+// retryOnConflict fetches the story and applies a change to it. When someone
+// edits the story in Taiga in between, the story is fetched again and only the
+// change is applied again.
+func (b *Bridge) retryOnConflict(ctx context.Context, taskId int, apply func(story taiga.UserStory) error) error {
+	for attempt := 1; ; attempt++ {
+		story, err := b.taiga.GetUserStory(ctx, taskId)
+		if err != nil {
+			return err
+		}
+		err = apply(story)
+		if !errors.Is(err, taiga.ErrVersionConflict) {
+			return err
+		}
+		if attempt == maxVersionRetries {
+			return fmt.Errorf("user story %d kept changing in Taiga: %w", taskId, err)
+		}
+	}
+}
+
+type ProjectMetadata struct {
+	Slug      string
+	Members   []taiga.Membership
+	Points    []taiga.Point
+	Roles     []taiga.Role
+	Tags      []string
+	FetchedAt time.Time
+}
+
+// getProjectMetadata returns the slug, members, points, roles and tags of a
+// project. They are cached for a few minutes because autocomplete has to
+// answer fast.
+func (b *Bridge) getProjectMetadata(ctx context.Context, projectId int) (ProjectMetadata, error) {
+	b.metadataLock.Lock()
+	defer b.metadataLock.Unlock()
+	metadata, ok := b.metadataCache[projectId]
+	if ok && time.Since(metadata.FetchedAt) < 5*time.Minute {
+		return metadata, nil
+	}
+	metadata = ProjectMetadata{FetchedAt: time.Now()}
+	members, err := b.taiga.ListMemberships(ctx, projectId)
+	if err != nil {
+		return metadata, err
+	}
+	project, err := b.taiga.GetProject(ctx, projectId)
+	if err != nil {
+		return metadata, err
+	}
+	tagsColors, err := b.taiga.GetTagsColors(ctx, projectId)
+	if err != nil {
+		return metadata, err
+	}
+	metadata.Slug = project.Slug
+	metadata.Members = members
+	metadata.Points = project.Points
+	metadata.Roles = project.Roles
+	for tag := range tagsColors {
+		metadata.Tags = append(metadata.Tags, tag)
+	}
+	sort.Strings(metadata.Tags)
+	sort.Slice(metadata.Points, func(i, j int) bool {
+		return metadata.Points[i].Order < metadata.Points[j].Order
+	})
+	sort.Slice(metadata.Roles, func(i, j int) bool {
+		return metadata.Roles[i].Order < metadata.Roles[j].Order
+	})
+	b.metadataCache[projectId] = metadata
+	return metadata, nil
+}
@@ -0,0 +1,299 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The bridge keeps its metrics itself and writes them in the Prometheus text
+// format, they are few enough not to need a client library.
+
+const (
+	metricThreadsSynced     = "taiga_discord_threads_synced_total"
+	metricCommentsSynced    = "taiga_discord_comments_synced_total"
+	metricAttachmentsSynced = "taiga_discord_attachments_synced_total"
+	metricStatusChanges     = "taiga_discord_status_changes_total"
+	metricTaigaRequests     = "taiga_discord_taiga_requests_total"
+	metricTaigaErrors       = "taiga_discord_taiga_request_errors_total"
+	metricTaigaDuration     = "taiga_discord_taiga_request_duration_seconds"
+	metricPollDuration      = "taiga_discord_poll_duration_seconds"
+	metricLastPoll          = "taiga_discord_last_poll_timestamp_seconds"
+	metricJobsRun           = "taiga_discord_outbox_jobs_run_total"
+	metricOutboxJobs        = "taiga_discord_outbox_jobs"
+	metricOutboxOldest      = "taiga_discord_outbox_oldest_pending_seconds"
+	metricDiscordConnected  = "taiga_discord_discord_connected"
+
+	toTaiga   = "to_taiga"
+	toDiscord = "to_discord"
+
+	healthTimeout = 5 * time.Second
+)
+
+var durationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type metricInfo struct {
+	kind string
+	help string
+}
+
+var metricInfos = map[string]metricInfo{
+	metricThreadsSynced:     {"counter", "Threads created as stories, or stories published as threads."},
+	metricCommentsSynced:    {"counter", "Comments created from Discord messages, or messages posted from Taiga comments."},
+	metricAttachmentsSynced: {"counter", "Attachments uploaded to Taiga."},
+	metricStatusChanges:     {"counter", "Status changes written to Taiga or applied to threads."},
+	metricTaigaRequests:     {"counter", "Requests to Taiga by endpoint and status code, 0 when there was no response."},
+	metricTaigaErrors:       {"counter", "Requests to Taiga that failed or responded outside of 2xx."},
+	metricTaigaDuration:     {"histogram", "Duration of requests to Taiga."},
+	metricPollDuration:      {"histogram", "Duration of a round of polling Taiga for changes."},
+	metricLastPoll:          {"gauge", "When polling Taiga for changes last finished."},
+	metricJobsRun:           {"counter", "Outbox jobs run by kind and result: done, retry or dead."},
+	metricOutboxJobs:        {"gauge", "Jobs in the outbox by state."},
+	metricOutboxOldest:      {"gauge", "Age of the oldest pending outbox job."},
+	metricDiscordConnected:  {"gauge", "Whether the Discord gateway is connected."},
+}
+
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+type metrics struct {
+	lock       sync.Mutex
+	values     map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		values:     make(map[string]map[string]float64),
+		histograms: make(map[string]map[string]*histogram),
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats name and value pairs as the labels of a metric.
+func labels(pairs ...string) string {
+	var formatted []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		formatted = append(formatted, pairs[i]+`="`+labelEscaper.Replace(pairs[i+1])+`"`)
+	}
+	return strings.Join(formatted, ",")
+}
+
+func (m *metrics) add(name string, labels string, value float64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.values[name] == nil {
+		m.values[name] = make(map[string]float64)
+	}
+	m.values[name][labels] += value
+}
+
+func (m *metrics) set(name string, labels string, value float64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.values[name] == nil {
+		m.values[name] = make(map[string]float64)
+	}
+	m.values[name][labels] = value
+}
+
+func (m *metrics) observe(name string, labels string, duration time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.histograms[name] == nil {
+		m.histograms[name] = make(map[string]*histogram)
+	}
+	h := m.histograms[name][labels]
+	if h == nil {
+		h = &histogram{buckets: make([]uint64, len(durationBuckets))}
+		m.histograms[name][labels] = h
+	}
+	seconds := duration.Seconds()
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+func (m *metrics) write(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	names := make([]string, 0, len(metricInfos))
+	for name := range metricInfos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		info := metricInfos[name]
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, info.help, name, info.kind)
+		if info.kind == "histogram" {
+			for _, series := range sortedKeys(m.histograms[name]) {
+				h := m.histograms[name][series]
+				for i, bound := range durationBuckets {
+					fmt.Fprintf(w, "%s_bucket{%s} %d\n", name, joinLabels(series, labels("le", formatFloat(bound))), h.buckets[i])
+				}
+				fmt.Fprintf(w, "%s_bucket{%s} %d\n", name, joinLabels(series, labels("le", "+Inf")), h.count)
+				fmt.Fprintf(w, "%s_sum%s %s\n", name, braces(series), formatFloat(h.sum))
+				fmt.Fprintf(w, "%s_count%s %d\n", name, braces(series), h.count)
+			}
+			continue
+		}
+		for _, series := range sortedKeys(m.values[name]) {
+			fmt.Fprintf(w, "%s%s %s\n", name, braces(series), formatFloat(m.values[name][series]))
+		}
+	}
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func joinLabels(a string, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// ObserveTaigaRequest logs and records a request to Taiga. It fits the
+// OnRequest hook of *taiga.Client.
+func (b *Bridge) ObserveTaigaRequest(ctx context.Context, method string, endpoint string, statusCode int, duration time.Duration) {
+	level := slog.LevelDebug
+	if statusCode == 0 || statusCode >= 500 {
+		level = slog.LevelWarn
+	}
+	b.logger(ctx).Log(ctx, level, "Taiga request", "method", method, "endpoint", endpoint, "status", statusCode, "duration", duration)
+	b.metrics.add(metricTaigaRequests, labels("method", method, "endpoint", endpoint, "code", strconv.Itoa(statusCode)), 1)
+	if statusCode == 0 || statusCode >= 400 {
+		b.metrics.add(metricTaigaErrors, labels("method", method, "endpoint", endpoint), 1)
+	}
+	b.metrics.observe(metricTaigaDuration, labels("method", method, "endpoint", endpoint), duration)
+}
+
+// MetricsHandler serves the metrics on GET /metrics and the health of the
+// bridge on GET /healthz.
+func (b *Bridge) MetricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", b.handleMetrics)
+	mux.HandleFunc("GET /healthz", b.handleHealth)
+	return mux
+}
+
+func (b *Bridge) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	b.updateOutboxMetrics()
+	connected := 0.0
+	if b.discordReady() {
+		connected = 1
+	}
+	b.metrics.set(metricDiscordConnected, "", connected)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	b.metrics.write(w)
+}
+
+// updateOutboxMetrics counts the jobs by state when the metrics are scraped,
+// the jobs table is the queue.
+func (b *Bridge) updateOutboxMetrics() {
+	for _, state := range []string{jobPending, jobDead} {
+		var count int
+		err := b.db.QueryRow("SELECT COUNT(*) FROM jobs WHERE state = ?", state).Scan(&count)
+		if err != nil {
+			b.log.Error("Error counting jobs", "error", err)
+			return
+		}
+		b.metrics.set(metricOutboxJobs, labels("state", state), float64(count))
+	}
+	var oldest *int64
+	err := b.db.QueryRow("SELECT MIN(created_at) FROM jobs WHERE state = ?", jobPending).Scan(&oldest)
+	if err != nil {
+		b.log.Error("Error getting oldest job", "error", err)
+		return
+	}
+	age := 0.0
+	if oldest != nil {
+		age = time.Since(time.UnixMilli(*oldest)).Seconds()
+	}
+	b.metrics.set(metricOutboxOldest, "", age)
+}
+
+// discordReady reports whether the Discord gateway is connected.
+func (b *Bridge) discordReady() bool {
+	return b.connected.Load()
+}
+
+// handleHealth checks that the Discord gateway is connected, Taiga answers for
+// every project and the database can be written to. It responds with 503 when
+// one of them fails.
+func (b *Bridge) handleHealth(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+	defer cancel()
+	checks := map[string]string{
+		"discord": "ok",
+		"taiga":   "ok",
+		"db":      "ok",
+	}
+	if !b.discordReady() {
+		checks["discord"] = "gateway not connected"
+	}
+	projectIds := slices.Sorted(maps.Keys(b.projects))
+	for _, projectId := range projectIds {
+		_, err := b.taiga.GetProject(ctx, projectId)
+		if err != nil {
+			checks["taiga"] = "project " + strconv.Itoa(projectId) + ": " + err.Error()
+			break
+		}
+	}
+	err := b.checkDBWritable()
+	if err != nil {
+		checks["db"] = err.Error()
+	}
+	status := "ok"
+	code := http.StatusOK
+	for _, check := range checks {
+		if check != "ok" {
+			status = "unhealthy"
+			code = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]any{"status": status, "checks": checks})
+}
+
+// checkDBWritable writes to the database without changing it.
+func (b *Bridge) checkDBWritable() error {
+	_, err := b.db.Exec("UPDATE schema_version SET version = version")
+	return err
+}
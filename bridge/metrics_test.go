@@ -0,0 +1,73 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthChecksEveryProject(t *testing.T) {
+	tests := []struct {
+		name      string
+		errors    map[int]error
+		wantCode  int
+		wantTaiga string
+	}{
+		{name: "healthy", wantCode: http.StatusOK, wantTaiga: "ok"},
+		{name: "second project fails", errors: map[int]error{2: errors.New("forbidden")}, wantCode: http.StatusServiceUnavailable, wantTaiga: "project 2: forbidden"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newTestBridge(t, &fakeTaiga{projectErrors: test.errors},
+				ProjectConfig{Id: 1, ChannelId: "forum1"},
+				ProjectConfig{Id: 2, ChannelId: "forum2"},
+			)
+			b.connected.Store(true)
+			recorder := httptest.NewRecorder()
+			b.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+			var body struct {
+				Checks map[string]string `json:"checks"`
+			}
+			err := json.Unmarshal(recorder.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if recorder.Code != test.wantCode || body.Checks["taiga"] != test.wantTaiga {
+				t.Errorf("got %d with Taiga %q, want %d with %q", recorder.Code, body.Checks["taiga"], test.wantCode, test.wantTaiga)
+			}
+		})
+	}
+}
+
+func TestMetricsText(t *testing.T) {
+	m := newMetrics()
+	m.add(metricStatusChanges, labels("direction", toTaiga), 1)
+	m.add(metricStatusChanges, labels("direction", toTaiga), 2)
+	m.add(metricStatusChanges, labels("direction", toDiscord), 1)
+	m.set(metricDiscordConnected, "", 1)
+	m.observe(metricPollDuration, "", 300*time.Millisecond)
+	m.observe(metricPollDuration, "", 20*time.Second)
+	m.add(metricTaigaErrors, labels("method", "GET", "endpoint", `/a"b\c`), 1)
+	var text strings.Builder
+	m.write(&text)
+	tests := []string{
+		"# HELP taiga_discord_status_changes_total Status changes written to Taiga or applied to threads.\n# TYPE taiga_discord_status_changes_total counter\n" +
+			"taiga_discord_status_changes_total{direction=\"to_discord\"} 1\ntaiga_discord_status_changes_total{direction=\"to_taiga\"} 3\n",
+		"# TYPE taiga_discord_discord_connected gauge\ntaiga_discord_discord_connected 1\n",
+		"taiga_discord_poll_duration_seconds_bucket{le=\"0.25\"} 0\ntaiga_discord_poll_duration_seconds_bucket{le=\"0.5\"} 1\n",
+		"taiga_discord_poll_duration_seconds_bucket{le=\"30\"} 2\n",
+		"taiga_discord_poll_duration_seconds_bucket{le=\"+Inf\"} 2\ntaiga_discord_poll_duration_seconds_sum 20.3\ntaiga_discord_poll_duration_seconds_count 2\n",
+		`taiga_discord_taiga_request_errors_total{method="GET",endpoint="/a\"b\\c"} 1` + "\n",
+		// metrics without values still have their help
+		"# TYPE taiga_discord_outbox_jobs gauge\n# HELP",
+	}
+	for _, want := range tests {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("metrics do not contain\n%s\ngot\n%s", want, text.String())
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package bridge
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migrations upgrade the schema one version at a time. Migration i brings the
+// schema to version i+1. Only ever append to this list, a released migration
+// must not change.
+var migrations = [][]string{
+	// the tables created before there were migrations, existing databases
+	// already have them
+	{
+		"CREATE TABLE IF NOT EXISTS tasks (id INTEGER PRIMARY KEY AUTOINCREMENT, thread_id STRING, message_id STRING, task_id INTEGER, status_id INTEGER, UNIQUE(thread_id, task_id))",
+		"CREATE TABLE IF NOT EXISTS comments (id INTEGER PRIMARY KEY AUTOINCREMENT, message_id STRING, comment_id STRING, task_id INTEGER, updated_at INTEGER, UNIQUE(message_id, comment_id))",
+		"CREATE TABLE IF NOT EXISTS uploads (id INTEGER PRIMARY KEY AUTOINCREMENT, task_id INTEGER, message_id STRING, file_id STRING, taiga_file_id INTEGER, file_url STRING)",
+		"CREATE TABLE IF NOT EXISTS jobs (id INTEGER PRIMARY KEY AUTOINCREMENT, thread_id STRING, kind STRING, payload STRING, state STRING, attempts INTEGER, run_at INTEGER, last_error STRING, created_at INTEGER)",
+		"CREATE TABLE IF NOT EXISTS user_links (discord_id STRING PRIMARY KEY, taiga_user_id INTEGER, taiga_username STRING, code STRING, verified INTEGER, created_at INTEGER)",
+	},
+	{
+		"CREATE INDEX tasks_message_id ON tasks (message_id)",
+		"CREATE INDEX tasks_task_id ON tasks (task_id)",
+		"CREATE INDEX comments_message_id ON comments (message_id)",
+		"CREATE INDEX comments_task_id ON comments (task_id)",
+		"CREATE INDEX uploads_task_id_message_id ON uploads (task_id, message_id)",
+		"CREATE INDEX jobs_thread_id_state ON jobs (thread_id, state)",
+	},
+	{
+		"CREATE TABLE sync_marks (channel_id STRING PRIMARY KEY, message_id INTEGER, synced_at INTEGER)",
+	},
+	{
+		"CREATE TABLE imports (thread_id STRING PRIMARY KEY, started_at INTEGER, finished_at INTEGER)",
+	},
+	{
+		"ALTER TABLE jobs ADD COLUMN correlation_id STRING",
+	},
+	{
+		// comments written in Taiga before a story was synced are not
+		// mirrored, the stories synced so far start now
+		"ALTER TABLE tasks ADD COLUMN comments_since INTEGER",
+		"UPDATE tasks SET comments_since = CAST(strftime('%s', 'now') AS INTEGER) * 1000",
+	},
+}
+
+// SchemaVersion returns the version the schema of the database is at, 0 for a
+// database that was never migrated.
+func SchemaVersion(db DB) (int, error) {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)")
+	if err != nil {
+		return 0, err
+	}
+	var version int
+	err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	return version, err
+}
+
+// LatestSchemaVersion is the version Migrate brings a database to.
+func LatestSchemaVersion() int {
+	return len(migrations)
+}
+
+// Migrate brings the schema to the latest version and returns the version it
+// started from. Before changing a database that already has tables, a copy of
+// it is written to backupPath unless backupPath is empty. Every migration runs
+// in its own transaction, so a failed one leaves the previous version intact.
+func Migrate(db *sql.DB, backupPath string) (int, error) {
+	from, err := SchemaVersion(db)
+	if err != nil {
+		return 0, err
+	}
+	if from >= len(migrations) {
+		return from, nil
+	}
+	if backupPath != "" {
+		var tables int
+		err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name != 'schema_version'").Scan(&tables)
+		if err != nil {
+			return from, err
+		}
+		if tables > 0 {
+			_, err = db.Exec("VACUUM INTO ?", backupPath)
+			if err != nil {
+				return from, fmt.Errorf("backing up the database: %w", err)
+			}
+		}
+	}
+	for version := from; version < len(migrations); version++ {
+		err = runMigration(db, version)
+		if err != nil {
+			return from, fmt.Errorf("migrating to version %d: %w", version+1, err)
+		}
+	}
+	return from, nil
+}
+
+func runMigration(db *sql.DB, version int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, statement := range migrations[version] {
+		_, err = tx.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("INSERT INTO schema_version (version) VALUES (?)", version+1)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func checkSchema(db DB) error {
+	version, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version != len(migrations) {
+		return fmt.Errorf("bridge: the database schema is at version %d instead of %d, run Migrate first", version, len(migrations))
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package bridge
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		name string
+		// setup runs on the empty database before Migrate
+		setup      []string
+		wantFrom   int
+		wantBackup bool
+	}{
+		{name: "new database"},
+		{
+			name:       "database from before migrations",
+			setup:      migrations[0],
+			wantBackup: true,
+		},
+		{
+			name:       "partly migrated",
+			setup:      append(append(append([]string{}, migrations[0]...), migrations[1]...), "CREATE TABLE schema_version (version INTEGER NOT NULL)", "INSERT INTO schema_version VALUES (1), (2)"),
+			wantFrom:   2,
+			wantBackup: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			db, err := OpenDB(filepath.Join(dir, "tasks.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			for _, statement := range test.setup {
+				_, err = db.Exec(statement)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if checkSchema(db) == nil {
+				t.Error("checkSchema accepted the database before Migrate")
+			}
+			backup := filepath.Join(dir, "tasks.db.bak")
+			from, err := Migrate(db, backup)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if from != test.wantFrom {
+				t.Errorf("migrated from version %d, want %d", from, test.wantFrom)
+			}
+			_, err = os.Stat(backup)
+			if backedUp := err == nil; backedUp != test.wantBackup {
+				t.Errorf("backup written: %v, want %v", backedUp, test.wantBackup)
+			}
+			err = checkSchema(db)
+			if err != nil {
+				t.Error(err)
+			}
+			// a migrated database is left alone
+			from, err = Migrate(db, backup+".again")
+			if err != nil || from != LatestSchemaVersion() {
+				t.Errorf("migrating again started from %d with error %v, want %d", from, err, LatestSchemaVersion())
+			}
+			if _, err := os.Stat(backup + ".again"); err == nil {
+				t.Error("migrating again wrote a backup")
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+
+	"taiga-discord/taiga"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// When a story changes status its thread gets a notice, an embed with the
+// details of the story or the text of the StatusUpdate template.
+
+const (
+	StatusFormatEmbed = "embed"
+	StatusFormatText  = "text"
+
+	StatusFieldChangedBy = "changed_by"
+	StatusFieldAssignee  = "assignee"
+	StatusFieldPoints    = "points"
+	StatusFieldSprint    = "sprint"
+
+	discordEmbedTitleLimit = 256
+)
+
+var statusFields = []string{StatusFieldChangedBy, StatusFieldAssignee, StatusFieldPoints, StatusFieldSprint}
+
+// checkStatusFormat checks the status notice settings of a project.
+func checkStatusFormat(project ProjectConfig) error {
+	switch project.StatusFormat {
+	case "", StatusFormatEmbed, StatusFormatText:
+	default:
+		return errors.New("unknown status format " + project.StatusFormat)
+	}
+	for _, field := range project.StatusFields {
+		if !slices.Contains(statusFields, field) {
+			return errors.New("unknown status field " + field)
+		}
+	}
+	return nil
+}
+
+// postStatusUpdate posts the notice of a status change into its thread.
+func (b *Bridge) postStatusUpdate(ctx context.Context, projectId int, thread *discordgo.Channel, update StatusUpdate, oldStatusId int) error {
+	data := b.statusData(ctx, projectId, thread, update, oldStatusId)
+	message := &discordgo.MessageSend{
+		// the name of who changed it must not ping them
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	}
+	if b.projects[projectId].StatusFormat == StatusFormatText {
+		content, err := b.renderStatusUpdate(projectId, data)
+		if err != nil {
+			return err
+		}
+		message.Content = content
+	} else {
+		message.Embeds = []*discordgo.MessageEmbed{b.statusEmbed(projectId, data, update.Status)}
+	}
+	_, err := b.discord.ChannelMessageSendComplex(thread.ID, message)
+	return err
+}
+
+// statusData collects the details of the story for the notice. Details that
+// cannot be fetched are left out, the notice is posted anyway.
+func (b *Bridge) statusData(ctx context.Context, projectId int, thread *discordgo.Channel, update StatusUpdate, oldStatusId int) StatusData {
+	data := StatusData{
+		Status:     update.Status.Name,
+		IsClosed:   update.Status.IsClosed,
+		ThreadName: thread.Name,
+		Link:       discordLink(thread.GuildID, thread.ID, ""),
+		ChangedBy:  update.ChangedBy,
+	}
+	if oldStatusId != update.Status.Id {
+		if old, found := b.findStatus(projectId, oldStatusId); found {
+			data.OldStatus = old.Name
+		}
+	}
+	logger := b.logger(ctx)
+	story, err := b.taiga.GetUserStory(ctx, update.TaskId)
+	if err != nil {
+		logger.Warn("Error getting story for status notice", "story_id", update.TaskId, "error", err)
+		return data
+	}
+	data.Ref = story.Ref
+	data.Subject = story.Subject
+	data.Sprint = story.MilestoneName
+	metadata, err := b.getProjectMetadata(ctx, projectId)
+	if err != nil {
+		logger.Warn("Error getting project for status notice", "project_id", projectId, "error", err)
+	} else {
+		data.StoryLink = b.storyLink(metadata.Slug, story.Ref)
+		data.Assignee = assigneeName(metadata, story)
+		data.Points = pointsSummary(metadata, story)
+	}
+	if data.ChangedBy == "" {
+		data.ChangedBy, err = b.statusChangedBy(ctx, update.TaskId, update.Status.Id)
+		if err != nil {
+			logger.Warn("Error getting history for status notice", "story_id", update.TaskId, "error", err)
+		}
+	}
+	return data
+}
+
+// statusChangedBy returns who moved the story to a status in Taiga, or ""
+// when it was the bridge.
+func (b *Bridge) statusChangedBy(ctx context.Context, taskId int, statusId int) (string, error) {
+	history, err := b.taiga.GetUserStoryHistory(ctx, taskId)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range history {
+		if _, to, changed := entry.StatusChange(); changed && to == statusId {
+			if entry.User.Pk == b.getBotUserId(ctx) {
+				return "", nil
+			}
+			if entry.User.Name != "" {
+				return entry.User.Name, nil
+			}
+			return entry.User.Username, nil
+		}
+	}
+	return "", nil
+}
+
+func (b *Bridge) storyLink(slug string, ref int) string {
+	return b.taiga.BaseURL() + "/project/" + slug + "/us/" + strconv.Itoa(ref)
+}
+
+func assigneeName(metadata ProjectMetadata, story taiga.UserStory) string {
+	if story.AssignedTo == nil {
+		return ""
+	}
+	for _, member := range metadata.Members {
+		if member.User != nil && *member.User == *story.AssignedTo {
+			return member.FullName
+		}
+	}
+	return ""
+}
+
+// pointsSummary lists the estimated points of the story by role, like
+// "UX: 2, Back: 5".
+func pointsSummary(metadata ProjectMetadata, story taiga.UserStory) string {
+	var points []string
+	for _, role := range metadata.Roles {
+		pointId, ok := story.Points[strconv.Itoa(role.Id)]
+		if !role.Computable || !ok {
+			continue
+		}
+		for _, point := range metadata.Points {
+			if point.Id == pointId && point.Value != nil {
+				points = append(points, role.Name+": "+point.Name)
+			}
+		}
+	}
+	return strings.Join(points, ", ")
+}
+
+func (b *Bridge) statusEmbed(projectId int, data StatusData, status Status) *discordgo.MessageEmbed {
+	title := data.ThreadName
+	if data.Ref != 0 {
+		title = "#" + strconv.Itoa(data.Ref) + " " + data.Subject
+	}
+	change := "**" + data.Status + "**"
+	if data.OldStatus != "" {
+		change = data.OldStatus + " → " + change
+	}
+	embed := &discordgo.MessageEmbed{
+		Title:  truncate(title, discordEmbedTitleLimit),
+		URL:    data.StoryLink,
+		Color:  statusColor(status.Color),
+		Fields: []*discordgo.MessageEmbedField{{Name: "Status", Value: change}},
+	}
+	fields := b.projects[projectId].StatusFields
+	if len(fields) == 0 {
+		fields = statusFields
+	}
+	values := map[string][2]string{
+		StatusFieldChangedBy: {"Changed by", data.ChangedBy},
+		StatusFieldAssignee:  {"Assigned to", data.Assignee},
+		StatusFieldPoints:    {"Points", data.Points},
+		StatusFieldSprint:    {"Sprint", data.Sprint},
+	}
+	for _, field := range fields {
+		value := values[field]
+		if value[1] == "" {
+			continue
+		}
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: value[0], Value: value[1], Inline: true})
+	}
+	return embed
+}
+
+// statusColor converts a Taiga color like "#70728F" for an embed.
+func statusColor(color string) int {
+	value, err := strconv.ParseInt(strings.TrimPrefix(color, "#"), 16, 32)
+	if err != nil {
+		return 0
+	}
+	return int(value)
+}
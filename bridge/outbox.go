@@ -0,0 +1,542 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"taiga-discord/taiga"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Writes to Taiga caused by Discord events are stored in the jobs table before
+// they are run, so nothing is lost while Taiga is unreachable. Jobs of the same
+// thread run in the order they were created.
+
+const (
+	jobPending = "pending"
+	jobDead    = "dead"
+
+	jobBaseBackoff = 5 * time.Second
+	jobMaxBackoff  = 30 * time.Minute
+	jobTimeout     = 2 * time.Minute
+)
+
+var errInvalidJob = errors.New("invalid job")
+
+type Job struct {
+	Id            int
+	ThreadId      string
+	Kind          string
+	Payload       string
+	Attempts      int
+	CorrelationId string
+}
+
+// jobIds are the ids every payload may carry, for the log.
+type jobIds struct {
+	ProjectId int
+	MessageId string
+	Message   *struct {
+		ID string
+	}
+}
+
+type CreateTaskJob struct {
+	ProjectId   int
+	ThreadName  string
+	AppliedTags []string
+	Message     *discordgo.Message
+	// StatusId is the status of the new story, the default status when zero.
+	StatusId int
+}
+
+type MessageJob struct {
+	ProjectId int
+	Message   *discordgo.Message
+}
+
+type UpdateSubjectJob struct {
+	ProjectId int
+	Name      string
+}
+
+type UpdateStatusJob struct {
+	ProjectId int
+	StatusId  int
+}
+
+// enqueueJob stores a job with the correlation id of ctx, so it is logged
+// with the event that caused it.
+func (b *Bridge) enqueueJob(ctx context.Context, threadId string, kind string, payload any) {
+	body, err := json.Marshal(payload)
+	if err == nil {
+		now := time.Now().UnixMilli()
+		_, err = b.db.Exec("INSERT INTO jobs (thread_id, kind, payload, state, attempts, run_at, created_at, correlation_id) VALUES (?, ?, ?, ?, 0, ?, ?, ?)", threadId, kind, string(body), jobPending, now, now, correlationId(ctx))
+	}
+	if err != nil {
+		b.logger(ctx).Error("Error queuing job", "kind", kind, "thread_id", threadId, "error", err)
+		return
+	}
+	b.logger(ctx).Debug("Queued job", "kind", kind, "thread_id", threadId)
+	select {
+	case b.outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+func (b *Bridge) runOutbox(ctx context.Context) {
+	for ctx.Err() == nil {
+		if b.dispatchJobs(ctx) > 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+		case <-b.outboxWake:
+		case <-time.After(time.Second):
+		}
+	}
+	b.jobsRunning.Wait()
+}
+
+// dispatchJobs queues the oldest pending job of every thread that is due and
+// has no job running, and returns how many jobs were queued. A job waiting for
+// a retry holds back the later jobs of its thread. Queued jobs that did not
+// start when ctx is done stay pending, a job that started is not interrupted.
+func (b *Bridge) dispatchJobs(ctx context.Context) int {
+	row, err := b.db.Query("SELECT id, thread_id, kind, payload, attempts, COALESCE(correlation_id, '') FROM jobs j WHERE state = ? AND run_at <= ? AND id = (SELECT MIN(id) FROM jobs WHERE thread_id = j.thread_id AND state = ?) ORDER BY id", jobPending, time.Now().UnixMilli(), jobPending)
+	if err != nil {
+		b.logger(ctx).Error("Error getting jobs", "error", err)
+		return 0
+	}
+	var jobs []Job
+	for row.Next() {
+		var job Job
+		err = row.Scan(&job.Id, &job.ThreadId, &job.Kind, &job.Payload, &job.Attempts, &job.CorrelationId)
+		if err != nil {
+			row.Close()
+			b.logger(ctx).Error("Error getting jobs", "error", err)
+			return 0
+		}
+		jobs = append(jobs, job)
+	}
+	row.Close()
+	dispatched := 0
+	for _, job := range jobs {
+		if b.jobs.busy(job.ThreadId) {
+			continue
+		}
+		dispatched++
+		b.jobsRunning.Add(1)
+		b.jobs.add(job.ThreadId, func() {
+			defer b.jobsRunning.Done()
+			if ctx.Err() != nil {
+				return
+			}
+			defer b.recoverPanic(b.jobContext(job))
+			b.processJob(job)
+			select {
+			case b.outboxWake <- struct{}{}:
+			default:
+			}
+		})
+	}
+	return dispatched
+}
+
+// onThread runs a change that is not a job, like one coming from Taiga or a
+// command, behind the jobs of threadId and waits for it, so writes to a
+// thread never run at the same time. It returns early when ctx is done, the
+// change still runs.
+func (b *Bridge) onThread(ctx context.Context, threadId string, work func() error) error {
+	done := make(chan error, 1)
+	b.jobsRunning.Add(1)
+	b.jobs.add(threadId, func() {
+		defer b.jobsRunning.Done()
+		defer func() {
+			if r := recover(); r != nil {
+				b.logger(ctx).Error("Panic", "panic", r, "stack", string(debug.Stack()))
+				done <- fmt.Errorf("panic: %v", r)
+			}
+		}()
+		done <- work()
+		// a job of the thread may have been skipped while it was busy
+		select {
+		case b.outboxWake <- struct{}{}:
+		default:
+		}
+	})
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// processJob runs a job and removes it, or schedules a retry when it failed.
+func (b *Bridge) processJob(job Job) {
+	ctx, cancel := context.WithTimeout(b.jobContext(job), jobTimeout)
+	err := b.runJobRecovered(ctx, job)
+	cancel()
+	logger := b.logger(ctx)
+	if err == nil {
+		_, err = b.db.Exec("DELETE FROM jobs WHERE id = ?", job.Id)
+		if err != nil {
+			logger.Error("Error deleting job", "error", err)
+			return
+		}
+		b.metrics.add(metricJobsRun, labels("kind", job.Kind, "result", "done"), 1)
+		logger.Debug("Job done")
+		return
+	}
+	job.Attempts++
+	if !isRetryable(err) || job.Attempts >= b.maxJobAttempts() {
+		b.metrics.add(metricJobsRun, labels("kind", job.Kind, "result", jobDead), 1)
+		logger.Error("Job failed permanently", "attempts", job.Attempts, "error", err)
+		if errors.Is(err, taiga.ErrVersionConflict) {
+			b.reportConflict(ctx, job)
+		}
+		_, err = b.db.Exec("UPDATE jobs SET state = ?, attempts = ?, last_error = ? WHERE id = ?", jobDead, job.Attempts, err.Error(), job.Id)
+	} else {
+		logger.Warn("Job failed, retrying", "attempts", job.Attempts, "error", err)
+		b.metrics.add(metricJobsRun, labels("kind", job.Kind, "result", "retry"), 1)
+		runAt := time.Now().Add(retryDelay(err, job.Attempts)).UnixMilli()
+		_, err = b.db.Exec("UPDATE jobs SET attempts = ?, run_at = ?, last_error = ? WHERE id = ?", job.Attempts, runAt, err.Error(), job.Id)
+	}
+	if err != nil {
+		logger.Error("Error updating job", "error", err)
+	}
+}
+
+// runJobRecovered runs a job and turns a panic into an error that is not
+// retried, so the job is marked dead instead of crashing the bot.
+func (b *Bridge) runJobRecovered(ctx context.Context, job Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			b.logger(ctx).Error("Panic", "panic", r, "stack", string(debug.Stack()))
+			err = fmt.Errorf("%w: panic: %v", errInvalidJob, r)
+		}
+	}()
+	return b.runJob(ctx, job)
+}
+
+// reportConflict tells the thread that a change was not saved because the
+// story kept being edited in Taiga at the same time.
+func (b *Bridge) reportConflict(ctx context.Context, job Job) {
+	_, err := b.discord.ChannelMessageSend(job.ThreadId, "A change from this thread could not be saved to Taiga because the user story was edited there at the same time. Please check the story and make the change again.")
+	if err != nil {
+		b.logger(ctx).Error("Error reporting conflict", "error", err)
+	}
+}
+
+// jobContext carries the logger of a job, with the correlation id of the
+// event that queued it and the ids it is about. It is canceled when Shutdown
+// gives up.
+func (b *Bridge) jobContext(job Job) context.Context {
+	args := []any{"job_id", job.Id, "kind", job.Kind, "thread_id", job.ThreadId}
+	var ids jobIds
+	if json.Unmarshal([]byte(job.Payload), &ids) == nil {
+		if ids.ProjectId != 0 {
+			args = append(args, "project_id", ids.ProjectId)
+		}
+		if ids.Message != nil {
+			ids.MessageId = ids.Message.ID
+		}
+		if ids.MessageId != "" {
+			args = append(args, "message_id", ids.MessageId)
+		}
+	}
+	if taskId, _, found, err := b.getThreadMapping(job.ThreadId); err == nil && found {
+		args = append(args, "story_id", taskId)
+	}
+	ctx := b.jobsCtx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return b.withCorrelation(ctx, job.CorrelationId, args...)
+}
+
+func (b *Bridge) maxJobAttempts() int {
+	return b.config.OutboxMaxAttempts
+}
+
+func jobBackoff(attempts int) time.Duration {
+	backoff := jobBaseBackoff
+	for i := 1; i < attempts && backoff < jobMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, jobMaxBackoff)
+}
+
+// retryDelay waits as long as Taiga asked for when it rate limited the job.
+func retryDelay(err error, attempts int) time.Duration {
+	var taigaError *taiga.Error
+	if errors.As(err, &taigaError) && taigaError.RetryAfter > 0 {
+		return min(taigaError.RetryAfter, jobMaxBackoff)
+	}
+	return jobBackoff(attempts)
+}
+
+// isRetryable reports whether a failed job may succeed later. Client errors
+// from Taiga or Discord will fail the same way again, except for rate limits
+// and timeouts.
+func isRetryable(err error) bool {
+	if errors.Is(err, errInvalidJob) || errors.Is(err, errTemplate) {
+		return false
+	}
+	var taigaError *taiga.Error
+	if errors.As(err, &taigaError) {
+		return taigaError.Temporary()
+	}
+	var restError *discordgo.RESTError
+	if errors.As(err, &restError) && restError.Response != nil {
+		statusCode := restError.Response.StatusCode
+		return statusCode >= 500 || statusCode == http.StatusTooManyRequests || statusCode == http.StatusRequestTimeout
+	}
+	return true
+}
+
+func decodeJob(job Job, payload any) error {
+	err := json.Unmarshal([]byte(job.Payload), payload)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errInvalidJob, err.Error())
+	}
+	return nil
+}
+
+func (b *Bridge) runJob(ctx context.Context, job Job) error {
+	switch job.Kind {
+	case "create_task":
+		var payload CreateTaskJob
+		err := decodeJob(job, &payload)
+		if err != nil {
+			return err
+		}
+		return b.runCreateTaskJob(ctx, job.ThreadId, payload)
+	case "create_comment":
+		var payload MessageJob
+		err := decodeJob(job, &payload)
+		if err != nil {
+			return err
+		}
+		return b.createComment(ctx, payload.ProjectId, job.ThreadId, payload.Message)
+	case "update_message":
+		var payload MessageJob
+		err := decodeJob(job, &payload)
+		if err != nil {
+			return err
+		}
+		return b.runUpdateMessageJob(ctx, payload)
+	case "update_subject":
+		var payload UpdateSubjectJob
+		err := decodeJob(job, &payload)
+		if err != nil {
+			return err
+		}
+		taskId, _, found, err := b.getThreadMapping(job.ThreadId)
+		if err != nil || !found {
+			return err
+		}
+		return b.updateTask(ctx, taskId, &payload.Name, nil)
+	case "update_status":
+		var payload UpdateStatusJob
+		err := decodeJob(job, &payload)
+		if err != nil {
+			return err
+		}
+		return b.runUpdateStatusJob(ctx, job.ThreadId, payload)
+	case "delete_message":
+		var payload DeleteMessageJob
+		err := decodeJob(job, &payload)
+		if err != nil {
+			return err
+		}
+		return b.runDeleteMessageJob(ctx, payload)
+	case "close_task", "reopen_task":
+		var payload ThreadJob
+		err := decodeJob(job, &payload)
+		if err != nil {
+			return err
+		}
+		return b.runLifecycleJob(ctx, job.ThreadId, payload, job.Kind == "close_task")
+	case "delete_thread":
+		var payload ThreadJob
+		err := decodeJob(job, &payload)
+		if err != nil {
+			return err
+		}
+		return b.runDeleteThreadJob(ctx, job.ThreadId, payload)
+	}
+	return fmt.Errorf("%w: unknown kind %s", errInvalidJob, job.Kind)
+}
+
+func (b *Bridge) getThreadMapping(threadId string) (int, int, bool, error) {
+	row, err := b.db.Query("SELECT task_id, status_id FROM tasks WHERE thread_id = ?", threadId)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	defer row.Close()
+	if !row.Next() {
+		return 0, 0, false, nil
+	}
+	var taskId int
+	var statusId int
+	err = row.Scan(&taskId, &statusId)
+	return taskId, statusId, err == nil, err
+}
+
+// runCreateTaskJob creates the story for a new forum post. When a previous
+// attempt already created the story, only the remaining steps are repeated.
+func (b *Bridge) runCreateTaskJob(ctx context.Context, threadId string, job CreateTaskJob) error {
+	message := job.Message
+	taskId, _, found, err := b.getThreadMapping(threadId)
+	if err != nil {
+		return err
+	}
+	if !found {
+		status := job.StatusId
+		if status == 0 {
+			status = b.statuses.defaultStatus(job.ProjectId)
+		}
+		tasks, err := b.taiga.ListUserStories(ctx, job.ProjectId, status)
+		if err != nil {
+			return err
+		}
+		// the attachments are added once the story exists to upload them to
+		data, err := b.messageData(job.ProjectId, threadId, message, nil)
+		if err != nil {
+			return err
+		}
+		data.ThreadName = job.ThreadName
+		if known, found := b.statuses.findById(job.ProjectId, status); found {
+			data.Status = known.Name
+		}
+		description, err := b.renderDescription(job.ProjectId, data)
+		if err != nil {
+			return err
+		}
+		taskId, err = b.createTask(ctx, job.ProjectId, status, job.ThreadName, description, threadId, message.ID)
+		if err != nil {
+			return err
+		}
+		ctx = b.withLog(ctx, "story_id", taskId)
+		err = b.sortTasks(ctx, job.ProjectId, tasks, taskId, status)
+		if err != nil {
+			b.logger(ctx).Error("Error sorting tasks", "error", err)
+		}
+		known, _ := b.statuses.findById(job.ProjectId, status)
+		appliedTags := b.statusTags(job.ProjectId, job.AppliedTags, known)
+		_, err = b.discord.ChannelEdit(threadId, &discordgo.ChannelEdit{
+			AppliedTags: &appliedTags,
+		})
+		if err != nil {
+			b.logger(ctx).Error("Error applying status tag", "error", err)
+		}
+	}
+	attachments, err := b.uploadAttachments(ctx, job.ProjectId, message.Attachments, taskId, message.ID)
+	if err != nil {
+		return err
+	}
+	data, err := b.messageData(job.ProjectId, threadId, message, attachments)
+	if err != nil {
+		return err
+	}
+	description, err := b.renderDescription(job.ProjectId, data)
+	if err != nil {
+		return err
+	}
+	err = b.updateTask(ctx, taskId, nil, &description)
+	if err != nil {
+		return err
+	}
+	b.watchTask(ctx, taskId, message.Author)
+	return nil
+}
+
+// runUpdateMessageJob syncs an edited message to the story description when
+// it started the thread, or to its comment otherwise.
+func (b *Bridge) runUpdateMessageJob(ctx context.Context, job MessageJob) error {
+	message := job.Message
+	row, err := b.db.Query("SELECT task_id FROM tasks WHERE message_id = ?", message.ID)
+	if err != nil {
+		return err
+	}
+	if row.Next() {
+		var taskId int
+		err = row.Scan(&taskId)
+		row.Close()
+		if err != nil {
+			return err
+		}
+		attachments, err := b.uploadAttachments(ctx, job.ProjectId, message.Attachments, taskId, message.ID)
+		if err != nil {
+			return err
+		}
+		data, err := b.messageData(job.ProjectId, message.ChannelID, message, attachments)
+		if err != nil {
+			return err
+		}
+		description, err := b.renderDescription(job.ProjectId, data)
+		if err != nil {
+			return err
+		}
+		err = b.updateTask(ctx, taskId, nil, &description)
+		if err != nil {
+			return err
+		}
+		return b.deleteUnusedAttachments(ctx, message.Attachments, taskId, message.ID)
+	}
+	row.Close()
+	row, err = b.db.Query("SELECT comment_id, task_id FROM comments WHERE message_id = ?", message.ID)
+	if err != nil {
+		return err
+	}
+	if !row.Next() {
+		row.Close()
+		return nil
+	}
+	var commentId string
+	var taskId int
+	err = row.Scan(&commentId, &taskId)
+	row.Close()
+	if err != nil {
+		return err
+	}
+	attachments, err := b.uploadAttachments(ctx, job.ProjectId, message.Attachments, taskId, message.ID)
+	if err != nil {
+		return err
+	}
+	err = b.updateComment(ctx, job.ProjectId, commentId, taskId, message, attachments)
+	if err != nil {
+		return err
+	}
+	return b.deleteUnusedAttachments(ctx, message.Attachments, taskId, message.ID)
+}
+
+func (b *Bridge) runUpdateStatusJob(ctx context.Context, threadId string, job UpdateStatusJob) error {
+	taskId, statusId, found, err := b.getThreadMapping(threadId)
+	if err != nil || !found {
+		return err
+	}
+	status, found := b.findStatus(job.ProjectId, job.StatusId)
+	if !found {
+		return fmt.Errorf("%w: unknown status %d", errInvalidJob, job.StatusId)
+	}
+	if statusId != status.Id {
+		err = b.updateTaskStatus(ctx, taskId, status.Id)
+		if err != nil {
+			return err
+		}
+	}
+	return b.applyStatusUpdate(ctx, StatusUpdate{
+		TaskId:   taskId,
+		ThreadId: threadId,
+		Status:   status,
+	})
+}
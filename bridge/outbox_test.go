@@ -0,0 +1,127 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"taiga-discord/taiga"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// A job that panics is marked dead instead of crashing the bot.
+func TestPanickingJobIsDead(t *testing.T) {
+	// deleting the story is not faked, so the job panics
+	b := newTestBridge(t, &fakeTaiga{}, ProjectConfig{Id: 1, ChannelId: "forum", ThreadDelete: deletePolicyDelete})
+	_, err := b.db.Exec("INSERT INTO tasks (thread_id, task_id, status_id, message_id) VALUES ('thread', 7, 1, 'thread')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	b.enqueueJob(ctx, "thread", "delete_thread", ThreadJob{ProjectId: 1})
+	if dispatched := b.dispatchJobs(ctx); dispatched != 1 {
+		t.Fatalf("dispatched %d jobs, want 1", dispatched)
+	}
+	b.jobsRunning.Wait()
+	var state, lastError string
+	err = b.db.QueryRow("SELECT state, last_error FROM jobs").Scan(&state, &lastError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != jobDead || !strings.Contains(lastError, "panic") {
+		t.Errorf("job is %s with error %q, want %s after a panic", state, lastError, jobDead)
+	}
+}
+
+// A job still running when Shutdown gives up is canceled, so it stops before
+// the database is closed.
+func TestShutdownCancelsRunningJobs(t *testing.T) {
+	b := newTestBridge(t, &fakeTaiga{})
+	// the contexts Start sets up
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	b.jobsCtx, b.cancelJobs = context.WithCancel(context.WithoutCancel(b.ctx))
+	jobCtx := b.jobContext(Job{Id: 1, ThreadId: "thread"})
+	b.jobsRunning.Add(1)
+	go func() {
+		<-jobCtx.Done()
+		b.jobsRunning.Done()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := b.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	select {
+	case <-jobCtx.Done():
+	case <-time.After(time.Second):
+		t.Error("the running job was not canceled")
+	}
+}
+
+func TestJobBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 5 * time.Second},
+		{2, 10 * time.Second},
+		{3, 20 * time.Second},
+		{9, 1280 * time.Second},
+		{10, jobMaxBackoff},
+		{100, jobMaxBackoff},
+	}
+	for _, test := range tests {
+		if got := jobBackoff(test.attempts); got != test.want {
+			t.Errorf("jobBackoff(%d) = %v, want %v", test.attempts, got, test.want)
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"network error", errors.New("connection refused"), true},
+		{"invalid job", fmt.Errorf("%w: bad payload", errInvalidJob), false},
+		{"template", fmt.Errorf("%w: no field", errTemplate), false},
+		{"Taiga server error", &taiga.Error{StatusCode: http.StatusBadGateway}, true},
+		{"Taiga rate limit", &taiga.Error{StatusCode: http.StatusTooManyRequests}, true},
+		{"Taiga timeout", &taiga.Error{StatusCode: http.StatusRequestTimeout}, true},
+		{"Taiga bad request", &taiga.Error{StatusCode: http.StatusBadRequest}, false},
+		{"Taiga forbidden", fmt.Errorf("patching: %w", &taiga.Error{StatusCode: http.StatusForbidden}), false},
+		{"Discord server error", &discordgo.RESTError{Response: &http.Response{StatusCode: http.StatusInternalServerError}}, true},
+		{"Discord rate limit", &discordgo.RESTError{Response: &http.Response{StatusCode: http.StatusTooManyRequests}}, true},
+		{"Discord missing access", &discordgo.RESTError{Response: &http.Response{StatusCode: http.StatusForbidden}}, false},
+	}
+	for _, test := range tests {
+		if got := isRetryable(test.err); got != test.want {
+			t.Errorf("%s: isRetryable = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		attempts int
+		want     time.Duration
+	}{
+		{"backoff", errors.New("timeout"), 3, 20 * time.Second},
+		{"rate limited", &taiga.Error{StatusCode: http.StatusTooManyRequests, RetryAfter: 42 * time.Second}, 3, 42 * time.Second},
+		{"long rate limit", &taiga.Error{StatusCode: http.StatusTooManyRequests, RetryAfter: 2 * time.Hour}, 1, jobMaxBackoff},
+		{"server error", fmt.Errorf("adding comment: %w", &taiga.Error{StatusCode: http.StatusBadGateway}), 2, 10 * time.Second},
+	}
+	for _, test := range tests {
+		if got := retryDelay(test.err, test.attempts); got != test.want {
+			t.Errorf("%s: retryDelay = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
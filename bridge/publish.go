@@ -0,0 +1,123 @@
+package bridge
+
+import (
+	"encoding/json"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"taiga-discord/taiga"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const discordThreadNameLimit = 100
+
+type PublishedStory struct {
+	Id          int             `json:"id"`
+	Ref         int             `json:"ref"`
+	Subject     string          `json:"subject"`
+	Description string          `json:"description"`
+	Permalink   string          `json:"permalink"`
+	Tags        json.RawMessage `json:"tags"`
+	Status      WebhookStatus   `json:"status"`
+}
+
+// shouldPublishStory reports whether a story created in Taiga gets a forum
+// post. Publishing is enabled with PublishStories and can be limited to stories
+// carrying one of the PublishTags.
+func (b *Bridge) shouldPublishStory(projectId int, tags []string) bool {
+	project := b.project(projectId)
+	if !project.PublishStories {
+		return false
+	}
+	return len(project.PublishTags) == 0 || hasPublishTag(project, tags)
+}
+
+// publishTagAdded reports whether a change of a story added one of the
+// PublishTags. Only such a change publishes a story that has no forum post,
+// editing an older story or one whose thread was deleted does not.
+func (b *Bridge) publishTagAdded(projectId int, change *WebhookChange) bool {
+	if change == nil {
+		return false
+	}
+	var diff struct {
+		Tags *struct {
+			From json.RawMessage `json:"from"`
+			To   json.RawMessage `json:"to"`
+		} `json:"tags"`
+	}
+	if json.Unmarshal(change.Diff, &diff) != nil || diff.Tags == nil {
+		return false
+	}
+	before := taiga.ParseTags(diff.Tags.From)
+	var added []string
+	for _, tag := range taiga.ParseTags(diff.Tags.To) {
+		if !slices.ContainsFunc(before, func(old string) bool { return strings.EqualFold(old, tag) }) {
+			added = append(added, tag)
+		}
+	}
+	return hasPublishTag(b.project(projectId), added)
+}
+
+func hasPublishTag(project ProjectConfig, tags []string) bool {
+	for _, wanted := range project.PublishTags {
+		for _, tag := range tags {
+			if strings.EqualFold(tag, wanted) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// publishStory creates a forum post for a story created in Taiga and stores
+// the mapping, so the thread is synced like one created in Discord. It returns
+// the id of the thread.
+func (b *Bridge) publishStory(projectId int, story PublishedStory) (string, error) {
+	channelId := b.project(projectId).ChannelId
+	name := strings.TrimSpace(story.Subject)
+	if name == "" {
+		name = "#" + strconv.Itoa(story.Ref)
+	}
+	var appliedTags []string
+	for _, status := range b.statuses.get(projectId) {
+		if status.Id == story.Status.Id && status.TagId != "" {
+			appliedTags = append(appliedTags, status.TagId)
+		}
+	}
+	thread, err := b.discord.ForumThreadStartComplex(channelId, &discordgo.ThreadStart{
+		Name:        truncate(name, discordThreadNameLimit),
+		AppliedTags: appliedTags,
+	}, &discordgo.MessageSend{
+		Content:         renderStoryMessage(story),
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	})
+	if err != nil {
+		return "", err
+	}
+	// the starter message of a forum post shares its id with the thread
+	_, err = b.db.Exec("INSERT INTO tasks (thread_id, task_id, status_id, message_id, comments_since) VALUES (?, ?, ?, ?, ?)", thread.ID, story.Id, story.Status.Id, thread.ID, time.Now().UnixMilli())
+	if err != nil {
+		return "", err
+	}
+	b.metrics.add(metricThreadsSynced, labels("direction", toDiscord), 1)
+	return thread.ID, nil
+}
+
+var markdownHeading = regexp.MustCompile(`(?m)^#{4,6}\s+(.+)$`)
+var blankLines = regexp.MustCompile(`\n{3,}`)
+
+func renderStoryMessage(story PublishedStory) string {
+	link := "\n\nView in Taiga: " + story.Permalink
+	description := strings.TrimSpace(story.Description)
+	// Discord only renders headings up to ###
+	description = markdownHeading.ReplaceAllString(description, "**$1**")
+	description = blankLines.ReplaceAllString(description, "\n\n")
+	if description == "" {
+		return strings.TrimSpace(link)
+	}
+	return truncate(description, discordMessageLimit-len([]rune(link))) + link
+}
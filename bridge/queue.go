@@ -0,0 +1,86 @@
+package bridge
+
+import (
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// queue runs work in the order it was added for every key, and work of
+// different keys in parallel on at most a fixed number of workers. Discord
+// events are keyed by their thread so a message edit is never handled before
+// the message, outbox jobs the same way.
+type queue struct {
+	lock    sync.Mutex
+	pending map[string][]func()
+	slots   chan struct{}
+}
+
+func newQueue(workers int) *queue {
+	return &queue{
+		pending: make(map[string][]func()),
+		slots:   make(chan struct{}, workers),
+	}
+}
+
+// add queues work behind the earlier work of key.
+func (q *queue) add(key string, work func()) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.pending[key] = append(q.pending[key], work)
+	if len(q.pending[key]) == 1 {
+		go q.drain(key)
+	}
+}
+
+// busy reports whether work of key is queued or running.
+func (q *queue) busy(key string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.pending[key]) > 0
+}
+
+// drain runs the work of key until there is none left. The work stays at the
+// head of the list while it runs, so add knows that key is being drained.
+func (q *queue) drain(key string) {
+	for {
+		q.lock.Lock()
+		if len(q.pending[key]) == 0 {
+			delete(q.pending, key)
+			q.lock.Unlock()
+			return
+		}
+		work := q.pending[key][0]
+		q.lock.Unlock()
+
+		q.slots <- struct{}{}
+		work()
+		<-q.slots
+
+		q.lock.Lock()
+		q.pending[key] = q.pending[key][1:]
+		q.lock.Unlock()
+	}
+}
+
+// eventThread returns the thread, or channel, a Discord event belongs to.
+// Events that belong to none share the empty key.
+func eventThread(event any) string {
+	switch e := event.(type) {
+	case *discordgo.MessageCreate:
+		return e.ChannelID
+	case *discordgo.MessageUpdate:
+		return e.ChannelID
+	case *discordgo.MessageDelete:
+		return e.ChannelID
+	case *discordgo.MessageDeleteBulk:
+		return e.ChannelID
+	case *discordgo.ThreadUpdate:
+		return e.ID
+	case *discordgo.ThreadDelete:
+		return e.ID
+	case *discordgo.InteractionCreate:
+		return e.ChannelID
+	}
+	return ""
+}
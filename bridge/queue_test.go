@@ -0,0 +1,125 @@
+package bridge
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestQueueRunsWorkOfAKeyInOrder(t *testing.T) {
+	q := newQueue(4)
+	var lock sync.Mutex
+	var order []string
+	var done sync.WaitGroup
+	for _, item := range []string{"a1", "b1", "a2", "a3", "b2"} {
+		done.Add(1)
+		q.add(item[:1], func() {
+			defer done.Done()
+			// later work of the key must not overtake slow work
+			time.Sleep(time.Millisecond)
+			lock.Lock()
+			order = append(order, item)
+			lock.Unlock()
+		})
+	}
+	done.Wait()
+	for _, key := range []string{"a", "b"} {
+		var got []string
+		for _, item := range order {
+			if item[:1] == key {
+				got = append(got, item)
+			}
+		}
+		if !slices.IsSorted(got) {
+			t.Errorf("work of %s ran as %v", key, got)
+		}
+	}
+}
+
+func TestQueueLimitsWorkers(t *testing.T) {
+	q := newQueue(2)
+	var running, most atomic.Int32
+	var done sync.WaitGroup
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		done.Add(1)
+		q.add(key, func() {
+			defer done.Done()
+			now := running.Add(1)
+			for {
+				previous := most.Load()
+				if now <= previous || most.CompareAndSwap(previous, now) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			running.Add(-1)
+		})
+	}
+	done.Wait()
+	if most.Load() > 2 {
+		t.Errorf("%d workers ran at once, want at most 2", most.Load())
+	}
+}
+
+func TestQueueBusy(t *testing.T) {
+	q := newQueue(1)
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	q.add("a", func() { <-release })
+	q.add("a", func() { close(finished) })
+	if !q.busy("a") || q.busy("b") {
+		t.Fatalf("busy(a) = %v, busy(b) = %v, want true and false", q.busy("a"), q.busy("b"))
+	}
+	close(release)
+	<-finished
+	for q.busy("a") {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestEventThread(t *testing.T) {
+	tests := []struct {
+		event any
+		want  string
+	}{
+		{&discordgo.MessageCreate{Message: &discordgo.Message{ChannelID: "1"}}, "1"},
+		{&discordgo.MessageDelete{Message: &discordgo.Message{ChannelID: "2"}}, "2"},
+		{&discordgo.ThreadUpdate{Channel: &discordgo.Channel{ID: "3"}}, "3"},
+		{&discordgo.InteractionCreate{Interaction: &discordgo.Interaction{ChannelID: "4"}}, "4"},
+		{&discordgo.Ready{}, ""},
+	}
+	for _, test := range tests {
+		if got := eventThread(test.event); got != test.want {
+			t.Errorf("eventThread(%T) = %q, want %q", test.event, got, test.want)
+		}
+	}
+}
+
+// A change from Taiga waits for the job running in its thread.
+func TestOnThreadWaitsForJobs(t *testing.T) {
+	b := newTestBridge(t, &fakeTaiga{})
+	release := make(chan struct{})
+	var order []string
+	b.jobs.add("thread", func() {
+		<-release
+		order = append(order, "job")
+	})
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		close(release)
+	}()
+	err := b.onThread(t.Context(), "thread", func() error {
+		order = append(order, "taiga")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(order, []string{"job", "taiga"}) {
+		t.Errorf("ran %v, want the job first", order)
+	}
+}
@@ -0,0 +1,457 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"taiga-discord/taiga"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// The kinds of drift Reconcile finds between the database, Taiga and Discord,
+// and how they are fixed:
+//
+//   - missing_story: the story was deleted in Taiga. The mapping is removed
+//     and the thread gets a notice.
+//   - missing_thread: the thread was deleted in Discord. The mapping is
+//     removed, the story is left alone.
+//   - status_mismatch: the stored status or the thread's status tag differs
+//     from the story. Taiga wins, the thread is updated.
+//   - subject_mismatch: the thread name differs from the story subject.
+//     Discord wins, the subject is updated.
+//   - missing_attachment: an upload was deleted in Taiga. Its row is removed.
+//   - missing_comment: a synced comment was deleted in Taiga. Its row is
+//     removed.
+//   - wrong_comment: a message is linked to the comment of another message or
+//     person. The row is linked to the right comment, or removed when there is
+//     none.
+//   - orphan_comment, orphan_upload: rows of a story that is not mapped, or
+//     left half-written. They are removed.
+const (
+	DriftMissingStory      = "missing_story"
+	DriftMissingThread     = "missing_thread"
+	DriftStatusMismatch    = "status_mismatch"
+	DriftSubjectMismatch   = "subject_mismatch"
+	DriftMissingAttachment = "missing_attachment"
+	DriftMissingComment    = "missing_comment"
+	DriftWrongComment      = "wrong_comment"
+	DriftOrphanComment     = "orphan_comment"
+	DriftOrphanUpload      = "orphan_upload"
+)
+
+type Drift struct {
+	Kind     string `json:"kind"`
+	ThreadId string `json:"thread_id,omitempty"`
+	TaskId   int    `json:"task_id,omitempty"`
+	Detail   string `json:"detail"`
+	Fixed    bool   `json:"fixed"`
+	Error    string `json:"error,omitempty"`
+}
+
+type mapping struct {
+	ThreadId  string
+	TaskId    int
+	StatusId  int
+	ProjectId int
+}
+
+// Reconcile reports the drift between the database, Taiga and Discord and
+// repairs it when fix is set.
+func (b *Bridge) Reconcile(ctx context.Context, fix bool) ([]Drift, error) {
+	if !b.statuses.loaded() {
+		err := b.load(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	mappings, err := b.getMappings()
+	if err != nil {
+		return nil, err
+	}
+	// the session is not necessarily open, so the bot is looked up
+	bot, err := b.discord.User("@me")
+	if err != nil {
+		return nil, err
+	}
+	var drifts []Drift
+	report := func(drift Drift, repair func() error) {
+		if fix {
+			// repairs of a thread are ordered with its jobs
+			var err error
+			if drift.ThreadId != "" {
+				err = b.onThread(ctx, drift.ThreadId, repair)
+			} else {
+				err = repair()
+			}
+			if err != nil {
+				drift.Error = err.Error()
+			} else {
+				drift.Fixed = true
+			}
+		}
+		drifts = append(drifts, drift)
+	}
+	for _, m := range mappings {
+		if ctx.Err() != nil {
+			return drifts, ctx.Err()
+		}
+		err = b.reconcileMapping(ctx, m, bot.ID, report)
+		if err != nil {
+			return drifts, err
+		}
+	}
+	err = b.reconcileOrphans(report)
+	return drifts, err
+}
+
+func (b *Bridge) getMappings() ([]mapping, error) {
+	row, err := b.db.Query("SELECT thread_id, task_id, status_id FROM tasks")
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+	var mappings []mapping
+	for row.Next() {
+		var m mapping
+		err = row.Scan(&m.ThreadId, &m.TaskId, &m.StatusId)
+		if err != nil {
+			return nil, err
+		}
+		mappings = append(mappings, m)
+	}
+	return mappings, row.Err()
+}
+
+// reconcileMapping checks one mapping. Taiga and Discord errors are logged and
+// skip the mapping, database errors are returned.
+func (b *Bridge) reconcileMapping(ctx context.Context, m mapping, botId string, report func(Drift, func() error)) error {
+	story, err := b.taiga.GetUserStory(ctx, m.TaskId)
+	if errors.Is(err, taiga.ErrNotFound) {
+		report(Drift{Kind: DriftMissingStory, ThreadId: m.ThreadId, TaskId: m.TaskId, Detail: "the user story was deleted in Taiga"}, func() error {
+			b.discord.ChannelMessageSend(m.ThreadId, "The user story of this thread was deleted in Taiga, the thread is no longer synced.")
+			return b.forgetMapping(m)
+		})
+		return nil
+	}
+	if err != nil {
+		b.logger(ctx).Error("Error getting story", "story_id", m.TaskId, "thread_id", m.ThreadId, "error", err)
+		return nil
+	}
+	thread, err := b.discord.Channel(m.ThreadId)
+	if isDiscordNotFound(err) {
+		report(Drift{Kind: DriftMissingThread, ThreadId: m.ThreadId, TaskId: m.TaskId, Detail: "the thread was deleted in Discord"}, func() error {
+			return b.forgetMapping(m)
+		})
+		return nil
+	}
+	if err != nil {
+		b.logger(ctx).Error("Error getting thread", "story_id", m.TaskId, "thread_id", m.ThreadId, "error", err)
+		return nil
+	}
+	m.ProjectId = story.Project
+	status, found := b.findStatus(m.ProjectId, story.Status)
+	if found {
+		tagged, tagCount, hasTag := b.appliedStatus(m.ProjectId, thread.AppliedTags, story.Status)
+		if m.StatusId != story.Status || (status.TagId != "" && (!hasTag || tagged.Id != story.Status || tagCount != 1)) {
+			detail := "Taiga has \"" + status.Name + "\""
+			if hasTag {
+				detail += ", the thread is tagged \"" + tagged.Name + "\""
+			}
+			report(Drift{Kind: DriftStatusMismatch, ThreadId: m.ThreadId, TaskId: m.TaskId, Detail: detail}, func() error {
+				return b.applyStatusUpdate(ctx, StatusUpdate{TaskId: m.TaskId, ThreadId: m.ThreadId, Status: status})
+			})
+		}
+	}
+	if strings.TrimSpace(thread.Name) != truncate(strings.TrimSpace(story.Subject), discordThreadNameLimit) {
+		report(Drift{Kind: DriftSubjectMismatch, ThreadId: m.ThreadId, TaskId: m.TaskId, Detail: "Taiga has \"" + story.Subject + "\", the thread is called \"" + thread.Name + "\""}, func() error {
+			return b.updateTask(ctx, m.TaskId, &thread.Name, nil)
+		})
+	}
+	err = b.reconcileAttachments(ctx, m, report)
+	if err != nil {
+		return err
+	}
+	return b.reconcileComments(ctx, m, botId, report)
+}
+
+func (b *Bridge) reconcileAttachments(ctx context.Context, m mapping, report func(Drift, func() error)) error {
+	row, err := b.db.Query("SELECT id, taiga_file_id FROM uploads WHERE task_id = ?", m.TaskId)
+	if err != nil {
+		return err
+	}
+	uploads := make(map[int]int)
+	for row.Next() {
+		var id int
+		var taigaFileId int
+		err = row.Scan(&id, &taigaFileId)
+		if err != nil {
+			row.Close()
+			return err
+		}
+		uploads[id] = taigaFileId
+	}
+	row.Close()
+	if len(uploads) == 0 {
+		return nil
+	}
+	attachments, err := b.taiga.ListAttachments(ctx, m.ProjectId, m.TaskId)
+	if err != nil {
+		b.logger(ctx).Error("Error listing attachments", "story_id", m.TaskId, "error", err)
+		return nil
+	}
+	existing := make(map[int]bool)
+	for _, attachment := range attachments {
+		existing[attachment.Id] = true
+	}
+	for id, taigaFileId := range uploads {
+		if existing[taigaFileId] {
+			continue
+		}
+		report(Drift{Kind: DriftMissingAttachment, ThreadId: m.ThreadId, TaskId: m.TaskId, Detail: "attachment " + strconv.Itoa(taigaFileId) + " is gone from Taiga"}, func() error {
+			_, err := b.db.Exec("DELETE FROM uploads WHERE id = ?", id)
+			return err
+		})
+	}
+	return nil
+}
+
+type commentRow struct {
+	id        int
+	messageId string
+	commentId string
+}
+
+func (b *Bridge) reconcileComments(ctx context.Context, m mapping, botId string, report func(Drift, func() error)) error {
+	row, err := b.db.Query("SELECT id, message_id, comment_id FROM comments WHERE task_id = ? AND comment_id IS NOT NULL AND comment_id != ''", m.TaskId)
+	if err != nil {
+		return err
+	}
+	var comments []commentRow
+	for row.Next() {
+		var comment commentRow
+		err = row.Scan(&comment.id, &comment.messageId, &comment.commentId)
+		if err != nil {
+			row.Close()
+			return err
+		}
+		comments = append(comments, comment)
+	}
+	row.Close()
+	if len(comments) == 0 {
+		return nil
+	}
+	history, err := b.taiga.GetUserStoryHistory(ctx, m.TaskId)
+	if err != nil {
+		b.logger(ctx).Error("Error getting history", "story_id", m.TaskId, "error", err)
+		return nil
+	}
+	botUserId := b.getBotUserId(ctx)
+	entries := make(map[string]taiga.HistoryEntry)
+	marked := make(map[string]string)
+	for _, entry := range history {
+		if entry.DeleteCommentDate != nil {
+			continue
+		}
+		entries[entry.Id] = entry
+		if messageId := markedMessage(entry.Comment); messageId != "" && entry.User.Pk == botUserId {
+			marked[messageId] = entry.Id
+		}
+	}
+	var messages map[string]*discordgo.Message
+	var wrong []commentRow
+	linked := make(map[string]bool)
+	for _, comment := range comments {
+		entry, exists := entries[comment.commentId]
+		if !exists {
+			report(Drift{Kind: DriftMissingComment, ThreadId: m.ThreadId, TaskId: m.TaskId, Detail: "comment " + comment.commentId + " is gone from Taiga"}, func() error {
+				_, err := b.db.Exec("DELETE FROM comments WHERE id = ?", comment.id)
+				return err
+			})
+			continue
+		}
+		if commentId, found := marked[comment.messageId]; found || markedMessage(entry.Comment) != "" {
+			if commentId != comment.commentId {
+				wrong = append(wrong, comment)
+			} else {
+				linked[comment.commentId] = true
+			}
+			continue
+		}
+		// comments added before the markers can only be checked against the
+		// messages
+		if messages == nil {
+			messages, err = b.threadMessages(m.ThreadId)
+			if err != nil {
+				b.logger(ctx).Error("Error getting messages", "thread_id", m.ThreadId, "error", err)
+				return nil
+			}
+		}
+		message, found := messages[comment.messageId]
+		if !found || message.Author == nil {
+			// deleted messages are handled by the delete events
+			linked[comment.commentId] = true
+			continue
+		}
+		fromBot := message.Author.ID == botId
+		matches := false
+		if !fromBot && entry.User.Pk == botUserId {
+			matches, err = b.matchesMessage(entry.Comment, message)
+			if err != nil {
+				return err
+			}
+		}
+		if fromBot && entry.User.Pk != botUserId || matches {
+			linked[comment.commentId] = true
+			continue
+		}
+		wrong = append(wrong, comment)
+	}
+	for _, comment := range wrong {
+		// the comment with the marker of the message, or one without a marker
+		// that has its text
+		right, found := marked[comment.messageId]
+		message := messages[comment.messageId]
+		if !found && message != nil && message.Author != nil && message.Author.ID != botId {
+			for i := len(history) - 1; i >= 0; i-- {
+				entry := history[i]
+				if entry.User.Pk != botUserId || entry.DeleteCommentDate != nil || linked[entry.Id] || markedMessage(entry.Comment) != "" {
+					continue
+				}
+				matches, err := b.matchesMessage(entry.Comment, message)
+				if err != nil {
+					return err
+				}
+				if matches {
+					right, found = entry.Id, true
+					break
+				}
+			}
+		}
+		detail := "message " + comment.messageId + " is linked to comment " + comment.commentId
+		if !found {
+			report(Drift{Kind: DriftWrongComment, ThreadId: m.ThreadId, TaskId: m.TaskId, Detail: detail}, func() error {
+				_, err := b.db.Exec("DELETE FROM comments WHERE id = ?", comment.id)
+				return err
+			})
+			continue
+		}
+		linked[right] = true
+		report(Drift{Kind: DriftWrongComment, ThreadId: m.ThreadId, TaskId: m.TaskId, Detail: detail + " instead of " + right}, func() error {
+			_, err := b.db.Exec("UPDATE comments SET comment_id = ? WHERE id = ?", right, comment.id)
+			return err
+		})
+	}
+	return nil
+}
+
+// threadMessages returns every message of a thread by id.
+func (b *Bridge) threadMessages(threadId string) (map[string]*discordgo.Message, error) {
+	list, err := b.threadMessagesAfter(threadId, 0)
+	if err != nil {
+		return nil, err
+	}
+	messages := make(map[string]*discordgo.Message)
+	for _, message := range list {
+		messages[message.ID] = message
+	}
+	return messages, nil
+}
+
+// reconcileOrphans finds rows that belong to no mapping.
+func (b *Bridge) reconcileOrphans(report func(Drift, func() error)) error {
+	orphans := []struct {
+		kind  string
+		table string
+		query string
+	}{
+		{DriftOrphanComment, "comments", "SELECT id, task_id, message_id FROM comments WHERE task_id NOT IN (SELECT task_id FROM tasks) OR comment_id IS NULL OR comment_id = ''"},
+		{DriftOrphanUpload, "uploads", "SELECT id, task_id, message_id FROM uploads WHERE task_id NOT IN (SELECT task_id FROM tasks) OR taiga_file_id IS NULL"},
+	}
+	for _, orphan := range orphans {
+		row, err := b.db.Query(orphan.query)
+		if err != nil {
+			return err
+		}
+		var drifts []Drift
+		var ids []int
+		for row.Next() {
+			var id int
+			var taskId *int
+			var messageId *string
+			err = row.Scan(&id, &taskId, &messageId)
+			if err != nil {
+				row.Close()
+				return err
+			}
+			drift := Drift{Kind: orphan.kind, Detail: "row " + strconv.Itoa(id) + " of " + orphan.table}
+			if taskId != nil {
+				drift.TaskId = *taskId
+			}
+			if messageId != nil {
+				drift.Detail += " for message " + *messageId
+			}
+			drifts = append(drifts, drift)
+			ids = append(ids, id)
+		}
+		row.Close()
+		for i, drift := range drifts {
+			id := ids[i]
+			report(drift, func() error {
+				_, err := b.db.Exec("DELETE FROM "+orphan.table+" WHERE id = ?", id)
+				return err
+			})
+		}
+	}
+	return nil
+}
+
+// forgetMapping removes a thread and everything synced for it from the
+// database.
+func (b *Bridge) forgetMapping(m mapping) error {
+	_, err := b.db.Exec("DELETE FROM comments WHERE task_id = ?", m.TaskId)
+	if err != nil {
+		return err
+	}
+	_, err = b.db.Exec("DELETE FROM uploads WHERE task_id = ?", m.TaskId)
+	if err != nil {
+		return err
+	}
+	_, err = b.db.Exec("DELETE FROM tasks WHERE thread_id = ? AND task_id = ?", m.ThreadId, m.TaskId)
+	return err
+}
+
+func isDiscordNotFound(err error) bool {
+	var restError *discordgo.RESTError
+	return errors.As(err, &restError) && restError.Response != nil && restError.Response.StatusCode == http.StatusNotFound
+}
+
+// runReconcile repairs drift every ReconcileInterval.
+func (b *Bridge) runReconcile(ctx context.Context) {
+	ticker := time.NewTicker(b.config.ReconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		runCtx := b.withCorrelation(ctx, "", "event", "reconcile")
+		drifts, err := b.Reconcile(runCtx, true)
+		if err != nil {
+			b.logger(runCtx).Error("Error reconciling", "error", err)
+		}
+		for _, drift := range drifts {
+			logger := b.logger(runCtx).With("kind", drift.Kind, "thread_id", drift.ThreadId, "story_id", drift.TaskId, "detail", drift.Detail)
+			if drift.Error != "" {
+				logger.Error("Could not reconcile", "error", drift.Error)
+			} else {
+				logger.Info("Reconciled")
+			}
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package bridge
+
+import (
+	"context"
+	"testing"
+)
+
+// Database errors end a reconcile run with an error instead of a panic, which
+// would stop the scheduled runs for good.
+func TestReconcileReturnsDatabaseErrors(t *testing.T) {
+	tests := []struct {
+		table string
+		check func(b *Bridge, report func(Drift, func() error)) error
+	}{
+		{"uploads", func(b *Bridge, report func(Drift, func() error)) error {
+			return b.reconcileAttachments(context.Background(), mapping{ThreadId: "thread", TaskId: 7}, report)
+		}},
+		{"comments", func(b *Bridge, report func(Drift, func() error)) error {
+			return b.reconcileComments(context.Background(), mapping{ThreadId: "thread", TaskId: 7}, "bot", report)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.table, func(t *testing.T) {
+			b := newTestBridge(t, &fakeTaiga{})
+			_, err := b.db.Exec("DROP TABLE " + test.table)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = test.check(b, func(Drift, func() error) {})
+			if err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
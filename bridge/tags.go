@@ -0,0 +1,101 @@
+package bridge
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	discordTagNameLimit    = 20
+	discordAppliedTagLimit = 5
+)
+
+// setupStatusTags maps every kanban status of a project to the forum tag with
+// the same name on the project channel, creating missing tags.
+func (b *Bridge) setupStatusTags(projectId int) error {
+	channelId := b.project(projectId).ChannelId
+	channel, err := b.discord.Channel(channelId)
+	if err != nil {
+		return err
+	}
+	availableTags := channel.AvailableTags
+	missing := false
+	for _, status := range b.statuses.get(projectId) {
+		if findStatusTag(availableTags, status.Name) == "" {
+			availableTags = append(availableTags, discordgo.ForumTag{Name: truncate(status.Name, discordTagNameLimit)})
+			missing = true
+		}
+	}
+	if missing {
+		channel, err = b.discord.ChannelEdit(channelId, &discordgo.ChannelEdit{
+			AvailableTags: &availableTags,
+		})
+		if err != nil {
+			b.log.Error("Error creating forum tags", "project_id", projectId, "error", err)
+		} else {
+			availableTags = channel.AvailableTags
+		}
+	}
+	statuses := slices.Clone(b.statuses.get(projectId))
+	for i, status := range statuses {
+		statuses[i].TagId = findStatusTag(availableTags, status.Name)
+	}
+	b.statuses.set(projectId, statuses)
+	return nil
+}
+
+func findStatusTag(tags []discordgo.ForumTag, name string) string {
+	name = truncate(name, discordTagNameLimit)
+	for _, tag := range tags {
+		if tag.ID != "" && strings.EqualFold(tag.Name, name) {
+			return tag.ID
+		}
+	}
+	return ""
+}
+
+func (s *KanbanStatuses) findByTag(projectId int, tagId string) (Status, bool) {
+	for _, status := range s.get(projectId) {
+		if status.TagId != "" && status.TagId == tagId {
+			return status, true
+		}
+	}
+	return Status{}, false
+}
+
+// statusTags replaces the status tags in appliedTags with the tag of status,
+// keeping all other tags the thread has.
+func (b *Bridge) statusTags(projectId int, appliedTags []string, status Status) []string {
+	var tags []string
+	if status.TagId != "" {
+		tags = append(tags, status.TagId)
+	}
+	for _, tagId := range appliedTags {
+		if _, isStatus := b.statuses.findByTag(projectId, tagId); !isStatus && len(tags) < discordAppliedTagLimit {
+			tags = append(tags, tagId)
+		}
+	}
+	return tags
+}
+
+// appliedStatus returns the status selected with the thread's tags. When
+// several status tags are applied, the one differing from current wins.
+func (b *Bridge) appliedStatus(projectId int, appliedTags []string, current int) (Status, int, bool) {
+	var selected Status
+	found := false
+	count := 0
+	for _, tagId := range appliedTags {
+		status, isStatus := b.statuses.findByTag(projectId, tagId)
+		if !isStatus {
+			continue
+		}
+		count++
+		if !found || status.Id != current {
+			selected = status
+			found = true
+		}
+	}
+	return selected, count, found
+}
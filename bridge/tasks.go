@@ -0,0 +1,675 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"taiga-discord/taiga"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+type Status struct {
+	Name     string
+	Slug     string
+	Id       int
+	IsClosed bool
+	Color    string
+	TagId    string
+}
+
+// KanbanStatuses holds the statuses of every project. They are reloaded
+// while events are handled, so the list of a project is only ever replaced as
+// a whole and never changed in place.
+type KanbanStatuses struct {
+	lock     sync.RWMutex
+	projects map[int][]Status
+	defaults map[int]int
+}
+
+func newKanbanStatuses() *KanbanStatuses {
+	return &KanbanStatuses{
+		projects: make(map[int][]Status),
+		defaults: make(map[int]int),
+	}
+}
+
+// get returns the statuses of a project in board order. The list must not be
+// modified.
+func (s *KanbanStatuses) get(projectId int) []Status {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.projects[projectId]
+}
+
+func (s *KanbanStatuses) set(projectId int, statuses []Status) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.projects[projectId] = statuses
+}
+
+// defaultStatus is the status of new stories of a project.
+func (s *KanbanStatuses) defaultStatus(projectId int) int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.defaults[projectId]
+}
+
+func (s *KanbanStatuses) loaded() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.projects) > 0
+}
+
+// setupStatuses loads every user story status of the project in board order.
+// New stories start in the configured DefaultStatus, or in the project's
+// default status when it is not set.
+func (b *Bridge) setupStatuses(ctx context.Context, projectId int) error {
+	statuses, err := b.taiga.ListUserStoryStatuses(ctx, projectId)
+	if err != nil {
+		return err
+	}
+	previous := b.statuses.get(projectId)
+	var projectStatuses []Status
+	for _, status := range statuses {
+		// keep the forum tag until setupStatusTags looks it up again
+		tagId := ""
+		for _, known := range previous {
+			if known.Id == status.Id {
+				tagId = known.TagId
+			}
+		}
+		projectStatuses = append(projectStatuses, Status{
+			Name:     status.Name,
+			Slug:     status.Slug,
+			Id:       status.Id,
+			IsClosed: status.IsClosed,
+			Color:    status.Color,
+			TagId:    tagId,
+		})
+	}
+
+	defaultStatus := 0
+	defaultSlug := b.project(projectId).DefaultStatus
+	if defaultSlug != "" {
+		for _, status := range projectStatuses {
+			if status.Slug == defaultSlug {
+				defaultStatus = status.Id
+			}
+		}
+		if defaultStatus == 0 {
+			return errors.New("Could not find status " + defaultSlug)
+		}
+	} else {
+		project, err := b.taiga.GetProject(ctx, projectId)
+		if err != nil {
+			return err
+		}
+		defaultStatus = project.DefaultUsStatus
+	}
+	for _, slug := range []string{b.project(projectId).ArchiveStatus, b.project(projectId).ReopenStatus} {
+		if slug != "" && !slices.ContainsFunc(projectStatuses, func(status Status) bool { return status.Slug == slug }) {
+			return errors.New("Could not find status " + slug)
+		}
+	}
+	b.statuses.lock.Lock()
+	b.statuses.projects[projectId] = projectStatuses
+	b.statuses.defaults[projectId] = defaultStatus
+	b.statuses.lock.Unlock()
+	return nil
+}
+
+func (b *Bridge) changeTopicEvent(ctx context.Context, s *discordgo.Session, t *discordgo.ThreadUpdate) {
+	thread := t.ID
+	ctx = b.withLog(ctx, "thread_id", thread)
+	channel, err := b.channel(thread)
+	if err != nil {
+		b.logger(ctx).Error("Error getting channel", "error", err)
+		return
+	}
+	projectId, exists := b.channelProjects[channel.ParentID]
+	if !exists {
+		return
+	}
+	ctx = b.withLog(ctx, "project_id", projectId)
+	if t.BeforeUpdate == nil || t.BeforeUpdate.Name != t.Name {
+		b.enqueueJob(ctx, channel.ID, "update_subject", UpdateSubjectJob{ProjectId: projectId, Name: t.Name})
+	}
+	if t.BeforeUpdate != nil && slices.Equal(t.BeforeUpdate.AppliedTags, t.AppliedTags) {
+		return
+	}
+	_, statusId, found, err := b.getThreadMapping(channel.ID)
+	if err != nil {
+		b.logger(ctx).Error("Error getting story", "error", err)
+		return
+	}
+	if !found {
+		return
+	}
+	status, statusTagCount, found := b.appliedStatus(projectId, t.AppliedTags, statusId)
+	if !found || (status.Id == statusId && statusTagCount == 1) {
+		return
+	}
+	b.enqueueJob(ctx, channel.ID, "update_status", UpdateStatusJob{ProjectId: projectId, StatusId: status.Id})
+}
+
+func (b *Bridge) getProjectId(thread string) (int, error) {
+	channel, err := b.channel(thread)
+	if err != nil {
+		return 0, err
+	}
+	project, ok := b.channelProjects[channel.ParentID]
+	if !ok {
+		return 0, errors.New("Could not find project")
+	}
+	return project, nil
+}
+
+func (b *Bridge) changeMessageEvent(ctx context.Context, s *discordgo.Session, m *discordgo.MessageUpdate) {
+	if m.Author == nil || m.Author.ID == b.botId {
+		return
+	}
+	projectId, err := b.getProjectId(m.ChannelID)
+	if err != nil {
+		return
+	}
+	ctx = b.withLog(ctx, "project_id", projectId, "thread_id", m.ChannelID, "message_id", m.ID)
+	// the next catch-up replays the edit when it can not be marked
+	err = b.markSynced(m.ChannelID, "")
+	if err != nil {
+		b.logger(ctx).Error("Error marking thread as synced", "error", err)
+		return
+	}
+	b.enqueueJob(ctx, m.ChannelID, "update_message", MessageJob{ProjectId: projectId, Message: m.Message})
+}
+
+func (b *Bridge) updateTaskStatus(ctx context.Context, taskId int, statusId int) error {
+	err := b.patchTask(ctx, taskId, map[string]any{"status": statusId})
+	if err == nil {
+		b.metrics.add(metricStatusChanges, labels("direction", toTaiga), 1)
+	}
+	return err
+}
+
+func (b *Bridge) updateTask(ctx context.Context, taskId int, subject *string, description *string) error {
+	if description != nil {
+		return b.patchTask(ctx, taskId, map[string]any{"description": *description})
+	} else if subject != nil {
+		return b.patchTask(ctx, taskId, map[string]any{"subject": *subject})
+	}
+	return errors.New("No content or subject provided")
+}
+
+func (b *Bridge) updateComment(ctx context.Context, projectId int, commentId string, taskId int, message *discordgo.Message, attachments []Attachment) error {
+	data, err := b.messageData(projectId, message.ChannelID, message, attachments)
+	if err != nil {
+		return err
+	}
+	content, err := b.renderComment(projectId, data)
+	if err != nil {
+		return err
+	}
+	err = b.taiga.EditComment(ctx, taskId, commentId, content+commentMarker(message.ID))
+	if err != nil {
+		return err
+	}
+	_, err = b.db.Exec("UPDATE comments SET updated_at = ? WHERE comment_id = ?", message.EditedTimestamp, commentId)
+	return err
+}
+
+func (s *KanbanStatuses) findBySlug(projectId int, slug string) (Status, bool) {
+	for _, status := range s.get(projectId) {
+		if status.Slug == slug {
+			return status, true
+		}
+	}
+	return Status{}, false
+}
+
+func (s *KanbanStatuses) findById(projectId int, id int) (Status, bool) {
+	for _, status := range s.get(projectId) {
+		if status.Id == id {
+			return status, true
+		}
+	}
+	return Status{}, false
+}
+
+func (b *Bridge) createThreadEvent(ctx context.Context, s *discordgo.Session, t *discordgo.MessageCreate) {
+	if t.Author == nil || t.Author.ID == b.botId {
+		return
+	}
+	thread := t.ChannelID
+	projectId, err := b.getProjectId(thread)
+	if err != nil {
+		return
+	}
+	ctx = b.withLog(ctx, "project_id", projectId, "thread_id", thread, "message_id", t.ID)
+	channel, err := b.discord.Channel(thread)
+	if err != nil {
+		b.logger(ctx).Error("Error getting channel", "error", err)
+		return
+	}
+	err = b.syncMessage(ctx, projectId, channel, t.Message, channel.MessageCount == 0)
+	if err != nil {
+		b.logger(ctx).Error("Error marking message as synced", "error", err)
+	}
+}
+
+// syncMessage queues a new message of a thread for Taiga. The first message of
+// a thread creates the story, later ones become comments. A message whose mark
+// can not be moved is left to the next catch-up.
+func (b *Bridge) syncMessage(ctx context.Context, projectId int, channel *discordgo.Channel, message *discordgo.Message, first bool) error {
+	err := b.markSynced(channel.ID, message.ID)
+	if err != nil {
+		return err
+	}
+	if first {
+		err = b.markSynced(channel.ParentID, channel.ID)
+		if err != nil {
+			return err
+		}
+		// keep the status the post was tagged with when it was created
+		statusId := 0
+		if status, _, found := b.appliedStatus(projectId, channel.AppliedTags, 0); found {
+			statusId = status.Id
+		}
+		b.enqueueJob(ctx, channel.ID, "create_task", CreateTaskJob{
+			ProjectId:   projectId,
+			ThreadName:  channel.Name,
+			AppliedTags: channel.AppliedTags,
+			Message:     message,
+			StatusId:    statusId,
+		})
+	} else if message.Content != channel.Name {
+		b.enqueueJob(ctx, channel.ID, "create_comment", MessageJob{ProjectId: projectId, Message: message})
+		// posting in the thread of a closed story reopens it
+		_, statusId, found, err := b.getThreadMapping(channel.ID)
+		if err == nil && found {
+			if status, found := b.statuses.findById(projectId, statusId); found && status.IsClosed {
+				b.enqueueJob(ctx, channel.ID, "reopen_task", ThreadJob{ProjectId: projectId})
+			}
+		}
+	}
+	return nil
+}
+
+func (b *Bridge) attachFile(ctx context.Context, projectId int, attachment *discordgo.MessageAttachment, taskId int, messageId string) (string, error) {
+	row, err := b.db.Query("SELECT file_url FROM uploads WHERE message_id = ? AND file_id = ? AND task_id = ?", messageId, attachment.ID, taskId)
+	if err != nil {
+		return "", err
+	}
+	if row.Next() {
+		var fileUrl string
+		err = row.Scan(&fileUrl)
+		row.Close()
+		return fileUrl, err
+	}
+	row.Close()
+	fileRequest, err := http.NewRequestWithContext(ctx, "GET", attachment.URL, nil)
+	if err != nil {
+		return "", err
+	}
+	file, err := http.DefaultClient.Do(fileRequest)
+	if err != nil {
+		return "", err
+	}
+	defer file.Body.Close()
+	if file.StatusCode != http.StatusOK {
+		return "", errors.New("Could not download attachment " + attachment.Filename + ": " + file.Status)
+	}
+	uploaded, err := b.taiga.UploadAttachment(ctx, projectId, taskId, attachment.Filename, file.Body)
+	if err != nil {
+		return "", err
+	}
+	_, err = b.db.Exec("INSERT INTO uploads (message_id, file_id, taiga_file_id, file_url, task_id) VALUES (?, ?, ?, ?, ?)", messageId, attachment.ID, uploaded.Id, uploaded.PreviewURL, taskId)
+	if err != nil {
+		return "", err
+	}
+	b.metrics.add(metricAttachmentsSynced, "", 1)
+	return uploaded.PreviewURL, nil
+}
+
+// uploadAttachments attaches the files of a message to a story and returns
+// them for the templates.
+func (b *Bridge) uploadAttachments(ctx context.Context, projectId int, attachments []*discordgo.MessageAttachment, taskId int, messageId string) ([]Attachment, error) {
+	var uploaded []Attachment
+	for _, attachment := range attachments {
+		url, err := b.attachFile(ctx, projectId, attachment, taskId, messageId)
+		if err != nil {
+			return nil, err
+		}
+		uploaded = append(uploaded, Attachment{
+			Name:  attachment.Filename,
+			Url:   url,
+			Image: strings.HasPrefix(attachment.ContentType, "image"),
+		})
+	}
+	return uploaded, nil
+}
+
+type FileToDelete struct {
+	Id          int
+	TaigaFileId int
+}
+
+func (b *Bridge) deleteUnusedAttachments(ctx context.Context, attachments []*discordgo.MessageAttachment, taskId int, messageId string) error {
+	row, err := b.db.Query("SELECT id, taiga_file_id, file_id FROM uploads WHERE task_id = ? AND message_id = ?", taskId, messageId)
+	if err != nil {
+		return err
+	}
+	var filesToDelete []FileToDelete
+OUTER:
+	for row.Next() {
+		var uploadId int
+		var taigaFileId int
+		var fileId string
+		err = row.Scan(&uploadId, &taigaFileId, &fileId)
+		if err != nil {
+			row.Close()
+			return err
+		}
+		for _, attachment := range attachments {
+			if attachment.ID == fileId {
+				continue OUTER
+			}
+		}
+		filesToDelete = append(filesToDelete, FileToDelete{
+			Id:          uploadId,
+			TaigaFileId: taigaFileId,
+		})
+
+	}
+	row.Close()
+	for _, fileToDelete := range filesToDelete {
+		err = b.taiga.DeleteAttachment(ctx, fileToDelete.TaigaFileId)
+		if err != nil && !errors.Is(err, taiga.ErrNotFound) {
+			return err
+		}
+		_, err = b.db.Exec("DELETE FROM uploads WHERE id = ?", fileToDelete.Id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Bridge) createTask(ctx context.Context, projectId int, status_id int, title string, description string, threadId string, messageId string) (int, error) {
+	task, err := b.taiga.CreateUserStory(ctx, taiga.NewUserStory{
+		Subject:     title,
+		Description: description,
+		Project:     projectId,
+		Status:      status_id,
+		KanbanOrder: 1,
+	})
+	if err != nil {
+		return 0, err
+	}
+	_, err = b.db.Exec("INSERT INTO tasks (thread_id, task_id, status_id, message_id, comments_since) VALUES (?, ?, ?, ?, ?)", threadId, task.Id, status_id, messageId, time.Now().UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	b.metrics.add(metricThreadsSynced, labels("direction", toTaiga), 1)
+	return task.Id, nil
+}
+
+func (b *Bridge) checkStatuses(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute * 1)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		start := time.Now()
+		pollCtx := b.withCorrelation(ctx, "", "event", "poll")
+		modified := make(map[int]string)
+		for projectId := range b.projects {
+			for _, status := range b.statuses.get(projectId) {
+				b.checkTaskStatus(pollCtx, projectId, status.Id, modified)
+			}
+		}
+		b.checkComments(pollCtx, modified)
+		b.logger(pollCtx).Debug("Polled Taiga", "duration", time.Since(start))
+		b.metrics.observe(metricPollDuration, "", time.Since(start))
+		b.metrics.set(metricLastPoll, "", float64(time.Now().Unix()))
+	}
+}
+
+type StatusUpdate struct {
+	TaskId   int
+	ThreadId string
+	Status   Status
+	// ChangedBy is who changed the status when it was changed in Discord,
+	// otherwise it is looked up in the story's history.
+	ChangedBy string
+}
+
+// checkTaskStatus moves the threads of stories that left status in Taiga and
+// records the modified date of every story it sees in modified.
+func (b *Bridge) checkTaskStatus(ctx context.Context, projectId int, status int, modified map[int]string) {
+	tasks, err := b.taiga.ListUserStories(ctx, projectId, status)
+	if err != nil {
+		b.logger(ctx).Error("Error getting tasks", "project_id", projectId, "status_id", status, "error", err)
+		return
+	}
+	for _, task := range tasks {
+		modified[task.Id] = task.ModifiedDate
+	}
+	row, err := b.db.Query("SELECT task_id, thread_id FROM tasks WHERE status_id = ?", status)
+	if err != nil {
+		b.logger(ctx).Error("Error getting threads", "project_id", projectId, "status_id", status, "error", err)
+		return
+	}
+	var statusUpdate []StatusUpdate
+OUTER:
+	for row.Next() {
+		var taskId int
+		var threadId string
+		err = row.Scan(&taskId, &threadId)
+		if err != nil {
+			b.logger(ctx).Error("Error getting threads", "project_id", projectId, "status_id", status, "error", err)
+			break
+		}
+		for _, task := range tasks {
+			if task.Id == taskId {
+				continue OUTER
+			}
+		}
+		task, err := b.taiga.GetUserStory(ctx, taskId)
+		if err != nil {
+			b.logger(ctx).Error("Error getting task", "project_id", projectId, "story_id", taskId, "thread_id", threadId, "error", err)
+			continue
+		}
+		modified[task.Id] = task.ModifiedDate
+		for _, status := range b.statuses.get(projectId) {
+			if status.Id == task.Status {
+				statusUpdate = append(statusUpdate, StatusUpdate{
+					TaskId:   taskId,
+					ThreadId: threadId,
+					Status:   status,
+				})
+				break
+			}
+		}
+	}
+	row.Close()
+	for _, update := range statusUpdate {
+		changed := false
+		err = b.onThread(ctx, update.ThreadId, func() error {
+			changed, err = b.applyTaigaStatus(ctx, update)
+			return err
+		})
+		if err != nil {
+			b.logger(ctx).Error("Error applying status", "project_id", projectId, "story_id", update.TaskId, "thread_id", update.ThreadId, "error", err)
+			continue
+		}
+		if changed {
+			b.metrics.add(metricStatusChanges, labels("direction", toDiscord), 1)
+		}
+	}
+}
+
+// applyTaigaStatus applies a status change seen in Taiga unless the thread
+// already has the status, as when a job or command of the thread made the
+// change before it was seen. It has to run on the thread's queue and reports
+// whether the status changed.
+func (b *Bridge) applyTaigaStatus(ctx context.Context, update StatusUpdate) (bool, error) {
+	_, statusId, found, err := b.getThreadMapping(update.ThreadId)
+	if err != nil || !found || statusId == update.Status.Id {
+		return false, err
+	}
+	return true, b.applyStatusUpdate(ctx, update)
+}
+
+func (b *Bridge) applyStatusUpdate(ctx context.Context, update StatusUpdate) error {
+	thread, err := b.discord.Channel(update.ThreadId)
+	if err != nil {
+		return err
+	}
+	projectId, ok := b.channelProjects[thread.ParentID]
+	if !ok {
+		return errors.New("Could not find project")
+	}
+	_, oldStatusId, _, err := b.getThreadMapping(update.ThreadId)
+	if err != nil {
+		return err
+	}
+	// the row has to be updated first, the tag change below triggers a ThreadUpdate
+	_, err = b.db.Exec("UPDATE tasks SET status_id = ? WHERE task_id = ?", update.Status.Id, update.TaskId)
+	if err != nil {
+		return err
+	}
+	// archived threads can only be changed when they are reopened in the same request
+	appliedTags := b.statusTags(projectId, thread.AppliedTags, update.Status)
+	unarchived := false
+	err = b.editArchived(thread, &discordgo.ChannelEdit{
+		AppliedTags: &appliedTags,
+		Archived:    &unarchived,
+	})
+	if err != nil {
+		return err
+	}
+	err = b.postStatusUpdate(ctx, projectId, thread, update, oldStatusId)
+	if err != nil {
+		b.logger(ctx).Error("Error posting status notice", "error", err)
+	}
+
+	if update.Status.IsClosed {
+		val := true
+		edit := &discordgo.ChannelEdit{
+			Archived: &val,
+		}
+		err = b.editArchived(thread, edit)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type Attachment struct {
+	Name  string
+	Url   string
+	Image bool
+}
+
+func (b *Bridge) createComment(ctx context.Context, projectId int, threadId string, message *discordgo.Message) error {
+	row, err := b.db.Query("SELECT task_id FROM tasks WHERE thread_id = ?", threadId)
+	if err != nil {
+		return err
+	}
+	if !row.Next() {
+		row.Close()
+		return nil
+	}
+	var taskId int
+	err = row.Scan(&taskId)
+	row.Close()
+	if err != nil {
+		return err
+	}
+	row, err = b.db.Query("SELECT id FROM comments WHERE message_id = ?", message.ID)
+	if err != nil {
+		return err
+	}
+	if row.Next() {
+		row.Close()
+		return nil
+	}
+	row.Close()
+	// a retry after the comment was added only links it
+	commentId, found, err := b.findComment(ctx, taskId, message.ID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		attachments, err := b.uploadAttachments(ctx, projectId, message.Attachments, taskId, message.ID)
+		if err != nil {
+			return err
+		}
+		data, err := b.messageData(projectId, threadId, message, attachments)
+		if err != nil {
+			return err
+		}
+		comment, err := b.renderComment(projectId, data)
+		if err != nil {
+			return err
+		}
+		comment += commentMarker(message.ID)
+		err = b.retryOnConflict(ctx, taskId, func(story taiga.UserStory) error {
+			_, err := b.taiga.AddComment(ctx, taskId, story.Version, comment)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		commentId, found, err = b.findComment(ctx, taskId, message.ID)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return errors.New("Could not find the comment added to task " + strconv.Itoa(taskId))
+		}
+	}
+
+	messageID, err := strconv.ParseInt(message.ID, 10, 64)
+	if err != nil {
+		return err
+	}
+	timestamp := messageID >> 22
+	timestamp = timestamp + 1420070400000
+	_, err = b.db.Exec("INSERT INTO comments (message_id, comment_id, task_id, updated_at) VALUES (?, ?, ?, ?)", message.ID, commentId, taskId, timestamp)
+	if err != nil {
+		return err
+	}
+	b.metrics.add(metricCommentsSynced, labels("direction", toTaiga), 1)
+	b.watchTask(ctx, taskId, message.Author)
+	return nil
+}
+
+func (b *Bridge) sortTasks(ctx context.Context, projectId int, tasks []taiga.UserStory, newTask int, status int) error {
+	var sortStories []int
+	sortStories = append(sortStories, newTask)
+	for _, task := range tasks {
+		sortStories = append(sortStories, task.Id)
+	}
+	return b.taiga.BulkUpdateKanbanOrder(ctx, projectId, status, sortStories)
+}
+
+// getBotUserId returns the Taiga user id of the bot account, so changes made
+// by the bridge itself can be told apart from changes made in Taiga.
+func (b *Bridge) getBotUserId(ctx context.Context) int {
+	userId, err := b.taiga.UserID(ctx)
+	if err != nil {
+		b.logger(ctx).Error("Error getting Taiga user", "error", err)
+	}
+	return userId
+}
@@ -0,0 +1,92 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// A database error while a thread changes is logged, the rename is still
+// queued.
+func TestChangeTopicEventWithDatabaseError(t *testing.T) {
+	tests := []struct {
+		name   string
+		before *discordgo.Channel
+		want   []string
+	}{
+		{"tags changed", &discordgo.Channel{Name: "Bug"}, nil},
+		{"renamed", &discordgo.Channel{Name: "Old", AppliedTags: []string{"tag"}}, []string{"update_subject"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newTestBridge(t, &fakeTaiga{})
+			thread := &discordgo.Channel{ID: "thread", GuildID: "10", ParentID: "forum", Name: "Bug", AppliedTags: []string{"tag"}}
+			err := b.state().GuildAdd(&discordgo.Guild{ID: "10", Threads: []*discordgo.Channel{thread}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = b.db.Exec("DROP TABLE tasks")
+			if err != nil {
+				t.Fatal(err)
+			}
+			b.changeTopicEvent(context.Background(), nil, &discordgo.ThreadUpdate{Channel: thread, BeforeUpdate: test.before})
+			rows, err := b.db.Query("SELECT kind FROM jobs ORDER BY id")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+			var kinds []string
+			for rows.Next() {
+				var kind string
+				if err := rows.Scan(&kind); err != nil {
+					t.Fatal(err)
+				}
+				kinds = append(kinds, kind)
+			}
+			if !slices.Equal(kinds, test.want) {
+				t.Errorf("queued %v, want %v", kinds, test.want)
+			}
+		})
+	}
+}
+
+// A post keeps the status it was tagged with when it was created.
+func TestSyncMessageKeepsStatusTag(t *testing.T) {
+	tests := []struct {
+		name        string
+		appliedTags []string
+		want        int
+	}{
+		{"no tags", nil, 0},
+		{"other tag", []string{"bug"}, 0},
+		{"status tag", []string{"bug", "tag-done"}, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newTestBridge(t, &fakeTaiga{})
+			b.statuses.set(1, []Status{{Id: 1, Name: "New", TagId: "tag-new"}, {Id: 2, Name: "Done", TagId: "tag-done"}})
+			thread := &discordgo.Channel{ID: "thread", ParentID: "forum", Name: "Bug", AppliedTags: test.appliedTags}
+			message := &discordgo.Message{ID: "thread", ChannelID: "thread", Author: &discordgo.User{ID: "1"}}
+			err := b.syncMessage(context.Background(), 1, thread, message, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var payload string
+			err = b.db.QueryRow("SELECT payload FROM jobs WHERE kind = 'create_task'").Scan(&payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var job CreateTaskJob
+			err = json.Unmarshal([]byte(payload), &job)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if job.StatusId != test.want {
+				t.Errorf("story is created in status %d, want %d", job.StatusId, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Templates are the text/template templates for the text the bridge writes
+// for a project. Empty ones use the defaults.
+type Templates struct {
+	// Description is the description of a story created from a forum post,
+	// executed with MessageData.
+	Description string
+	// Comment is the Taiga comment for a message, executed with MessageData.
+	// The marker that ties the comment to its message is always appended.
+	Comment string
+	// StatusUpdate is the message posted in a thread when its story changes
+	// status and the project's StatusFormat is "text", executed with
+	// StatusData.
+	StatusUpdate string
+}
+
+const (
+	DefaultDescriptionTemplate  = "Created by {{.Author}}: \n\n{{.Content}}{{template \"attachments\" .}}"
+	DefaultCommentTemplate      = "Comment from {{.Author}}: \n\n{{.Content}}{{template \"attachments\" .}}"
+	DefaultStatusUpdateTemplate = `Task status has been updated to "{{.Status}}"`
+
+	// attachmentsTemplate can be used by every template as
+	// {{template "attachments" .}}
+	attachmentsTemplate = "{{define \"attachments\"}}{{if .Attachments}}\n\nAttachments:{{range .Attachments}}\n{{if .Image}}!{{end}}[{{.Name}}]({{.Url}}){{end}}{{end}}{{end}}"
+)
+
+// MessageData is what the description and comment templates are executed
+// with.
+type MessageData struct {
+	// Author is the linked Taiga username as a mention, or the Discord display
+	// name.
+	Author string
+	// Content is the message converted to Taiga markdown.
+	Content   string
+	Timestamp time.Time
+	// Link jumps to the message in Discord.
+	Link        string
+	ThreadName  string
+	Attachments []Attachment
+	// Status is the name of the story's status, empty before the story exists.
+	Status string
+}
+
+// StatusData is what the status update template is executed with. The
+// details of the story are empty when they could not be fetched.
+type StatusData struct {
+	Status   string
+	IsClosed bool
+	// OldStatus is empty when the bridge did not know the story's status.
+	OldStatus  string
+	ThreadName string
+	// Link jumps to the thread in Discord.
+	Link string
+	// ChangedBy is who changed the status, empty when it was the bridge.
+	ChangedBy string
+	Ref       int
+	Subject   string
+	// StoryLink opens the story in Taiga.
+	StoryLink string
+	Assignee  string
+	// Points lists the points by role, like "UX: 2, Back: 5".
+	Points string
+	Sprint string
+}
+
+var errTemplate = errors.New("template failed")
+
+type projectTemplates struct {
+	description  *template.Template
+	comment      *template.Template
+	statusUpdate *template.Template
+}
+
+// parseTemplates parses the templates of a project and executes them once, so
+// a template using a field that does not exist fails on startup.
+func parseTemplates(templates Templates) (*projectTemplates, error) {
+	parse := func(name string, text string, fallback string, data any) (*template.Template, error) {
+		if text == "" {
+			text = fallback
+		}
+		parsed, err := template.New(name).Parse(attachmentsTemplate)
+		if err == nil {
+			parsed, err = parsed.Parse(text)
+		}
+		if err == nil {
+			err = parsed.Execute(&strings.Builder{}, data)
+		}
+		return parsed, err
+	}
+	description, err := parse("description", templates.Description, DefaultDescriptionTemplate, MessageData{})
+	if err != nil {
+		return nil, err
+	}
+	comment, err := parse("comment", templates.Comment, DefaultCommentTemplate, MessageData{})
+	if err != nil {
+		return nil, err
+	}
+	statusUpdate, err := parse("status update", templates.StatusUpdate, DefaultStatusUpdateTemplate, StatusData{})
+	if err != nil {
+		return nil, err
+	}
+	return &projectTemplates{description: description, comment: comment, statusUpdate: statusUpdate}, nil
+}
+
+func render(tmpl *template.Template, data any) (string, error) {
+	var text strings.Builder
+	err := tmpl.Execute(&text, data)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", errTemplate, err.Error())
+	}
+	return text.String(), nil
+}
+
+func (b *Bridge) renderDescription(projectId int, data MessageData) (string, error) {
+	return render(b.templates[projectId].description, data)
+}
+
+func (b *Bridge) renderComment(projectId int, data MessageData) (string, error) {
+	return render(b.templates[projectId].comment, data)
+}
+
+func (b *Bridge) renderStatusUpdate(projectId int, data StatusData) (string, error) {
+	return render(b.templates[projectId].statusUpdate, data)
+}
+
+// messageData collects what the templates know about a message of a thread.
+func (b *Bridge) messageData(projectId int, threadId string, message *discordgo.Message, attachments []Attachment) (MessageData, error) {
+	author, err := b.authorName(message.Author)
+	if err != nil {
+		return MessageData{}, err
+	}
+	content, err := b.taigaMarkdown(message)
+	if err != nil {
+		return MessageData{}, err
+	}
+	data := MessageData{
+		Author:      author,
+		Content:     content,
+		Timestamp:   message.Timestamp,
+		Attachments: attachments,
+	}
+	guildId := message.GuildID
+	if thread, err := b.channel(threadId); err == nil {
+		data.ThreadName = thread.Name
+		guildId = thread.GuildID
+	}
+	data.Link = discordLink(guildId, threadId, message.ID)
+	if _, statusId, found, err := b.getThreadMapping(threadId); err == nil && found {
+		if status, found := b.findStatus(projectId, statusId); found {
+			data.Status = status.Name
+		}
+	}
+	return data, nil
+}
+
+// discordLink links to a channel, or to a message when messageId is set.
+func discordLink(guildId string, channelId string, messageId string) string {
+	link := "https://discord.com/channels/" + guildId + "/" + channelId
+	if messageId != "" {
+		link += "/" + messageId
+	}
+	return link
+}
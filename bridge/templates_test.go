@@ -0,0 +1,88 @@
+package bridge
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseTemplates(t *testing.T) {
+	tests := []struct {
+		name      string
+		templates Templates
+		wantErr   bool
+	}{
+		{name: "defaults"},
+		{name: "custom", templates: Templates{
+			Description:  "{{.Content}} ({{.ThreadName}}){{template \"attachments\" .}}",
+			Comment:      "{{.Author}} at {{.Timestamp.Format \"15:04\"}}: {{.Content}}",
+			StatusUpdate: "{{if .OldStatus}}{{.OldStatus}} → {{end}}{{.Status}} by {{.ChangedBy}}",
+		}},
+		{name: "syntax error", templates: Templates{Comment: "{{.Content"}, wantErr: true},
+		{name: "unknown field", templates: Templates{Description: "{{.Body}}"}, wantErr: true},
+		{name: "field of the other data", templates: Templates{StatusUpdate: "{{.Author}}"}, wantErr: true},
+		{name: "unknown template", templates: Templates{Comment: "{{template \"footer\" .}}"}, wantErr: true},
+	}
+	for _, test := range tests {
+		_, err := parseTemplates(test.templates)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %v", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestRenderTemplates(t *testing.T) {
+	parsed, err := parseTemplates(Templates{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := MessageData{
+		Author:    "@ann",
+		Content:   "Hello",
+		Timestamp: time.Unix(0, 0),
+		Attachments: []Attachment{
+			{Name: "screenshot.png", Url: "https://taiga.example/1.png", Image: true},
+			{Name: "log.txt", Url: "https://taiga.example/2.txt"},
+		},
+	}
+	tests := []struct {
+		name string
+		got  func() (string, error)
+		want string
+	}{
+		{
+			name: "description",
+			got:  func() (string, error) { return render(parsed.description, data) },
+			want: "Created by @ann: \n\nHello\n\nAttachments:\n![screenshot.png](https://taiga.example/1.png)\n[log.txt](https://taiga.example/2.txt)",
+		},
+		{
+			name: "comment without attachments",
+			got:  func() (string, error) { return render(parsed.comment, MessageData{Author: "Bob", Content: "Hi"}) },
+			want: "Comment from Bob: \n\nHi",
+		},
+		{
+			name: "status update",
+			got:  func() (string, error) { return render(parsed.statusUpdate, StatusData{Status: "Done"}) },
+			want: `Task status has been updated to "Done"`,
+		},
+	}
+	for _, test := range tests {
+		got, err := test.got()
+		if err != nil || got != test.want {
+			t.Errorf("%s: got %q (%v), want %q", test.name, got, err, test.want)
+		}
+	}
+}
+
+// A template that only fails for some messages passes the check on startup,
+// rendering it reports errTemplate so the job is not retried.
+func TestRenderFailure(t *testing.T) {
+	parsed, err := parseTemplates(Templates{Comment: "{{if .Attachments}}{{index .Attachments 1}}{{end}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = render(parsed.comment, MessageData{Attachments: []Attachment{{Name: "log.txt"}}})
+	if !errors.Is(err, errTemplate) {
+		t.Errorf("got error %v, want errTemplate", err)
+	}
+}
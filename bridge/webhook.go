@@ -0,0 +1,208 @@
+package bridge
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"taiga-discord/taiga"
+)
+
+type WebhookUser struct {
+	Id       int    `json:"id"`
+	Username string `json:"username"`
+	FullName string `json:"full_name"`
+}
+
+type WebhookChange struct {
+	Comment           string          `json:"comment"`
+	DeleteCommentDate *string         `json:"delete_comment_date"`
+	EditCommentDate   *string         `json:"edit_comment_date"`
+	Diff              json.RawMessage `json:"diff"`
+}
+
+type WebhookPayload struct {
+	Action string          `json:"action"`
+	Type   string          `json:"type"`
+	By     WebhookUser     `json:"by"`
+	Date   string          `json:"date"`
+	Data   json.RawMessage `json:"data"`
+	Change *WebhookChange  `json:"change"`
+}
+
+type WebhookStatus struct {
+	Id       int    `json:"id"`
+	Name     string `json:"name"`
+	Slug     string `json:"slug"`
+	IsClosed bool   `json:"is_closed"`
+}
+
+type WebhookProject struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type WebhookUserStory struct {
+	Id      int            `json:"id"`
+	Ref     int            `json:"ref"`
+	Subject string         `json:"subject"`
+	Status  WebhookStatus  `json:"status"`
+	Project WebhookProject `json:"project"`
+}
+
+// WebhookHandler serves the Taiga webhooks of every project on
+// POST /webhooks/taiga/{project}.
+func (b *Bridge) WebhookHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /webhooks/taiga/{project}", b.handleTaigaWebhook)
+	return mux
+}
+
+func verifyWebhookSignature(key string, body []byte, signature string) bool {
+	if key == "" || signature == "" {
+		return false
+	}
+	mac := hmac.New(sha1.New, []byte(key))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+func (b *Bridge) handleTaigaWebhook(w http.ResponseWriter, r *http.Request) {
+	project := r.PathValue("project")
+	projectId, err := strconv.Atoi(project)
+	if err != nil {
+		http.Error(w, "invalid project", http.StatusNotFound)
+		return
+	}
+	if _, ok := b.projects[projectId]; !ok {
+		http.Error(w, "unknown project", http.StatusNotFound)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "could not read body", http.StatusBadRequest)
+		return
+	}
+	if !verifyWebhookSignature(b.project(projectId).WebhookKey, body, r.Header.Get("X-TAIGA-WEBHOOK-SIGNATURE")) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	var payload WebhookPayload
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+	ctx := b.withCorrelation(r.Context(), "", "event", "webhook", "project_id", projectId, "type", payload.Type, "action", payload.Action)
+	switch payload.Type {
+	case "userstory":
+		err = b.handleUserStoryWebhook(ctx, projectId, payload)
+	}
+	if err != nil {
+		b.logger(ctx).Error("Error handling webhook", "error", err)
+		http.Error(w, "could not process webhook", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (b *Bridge) handleUserStoryWebhook(ctx context.Context, projectId int, payload WebhookPayload) error {
+	var story WebhookUserStory
+	err := json.Unmarshal(payload.Data, &story)
+	if err != nil {
+		return err
+	}
+	if story.Project.Id != projectId {
+		return fmt.Errorf("story %d does not belong to project %d", story.Id, projectId)
+	}
+	if payload.Action != "create" && payload.Action != "change" {
+		return nil
+	}
+	ctx = b.withLog(ctx, "story_id", story.Id)
+	var threadId string
+	var statusId int
+	err = b.db.QueryRow("SELECT thread_id, status_id FROM tasks WHERE task_id = ?", story.Id).Scan(&threadId, &statusId)
+	if errors.Is(err, sql.ErrNoRows) {
+		if payload.By.Id == b.getBotUserId(ctx) {
+			return nil
+		}
+		var published PublishedStory
+		err = json.Unmarshal(payload.Data, &published)
+		if err != nil {
+			return err
+		}
+		if !b.shouldPublishStory(projectId, taiga.ParseTags(published.Tags)) {
+			return nil
+		}
+		if payload.Action == "change" && !b.publishTagAdded(projectId, payload.Change) {
+			return nil
+		}
+		// new posts of the forum are created one at a time, so a repeated
+		// webhook finds the post of the first one
+		return b.onThread(ctx, b.project(projectId).ChannelId, func() error {
+			err := b.db.QueryRow("SELECT thread_id FROM tasks WHERE task_id = ?", story.Id).Scan(&threadId)
+			if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+			_, err = b.publishStory(projectId, published)
+			return err
+		})
+	}
+	if err != nil {
+		return err
+	}
+	if payload.Action != "change" {
+		return nil
+	}
+	if statusId != story.Status.Id {
+		status, found := b.findStatus(projectId, story.Status.Id)
+		if !found {
+			// the status was added in Taiga after the bot started
+			err = b.setupStatuses(ctx, projectId)
+			if err != nil {
+				return err
+			}
+			err = b.setupStatusTags(projectId)
+			if err != nil {
+				return err
+			}
+			status, found = b.findStatus(projectId, story.Status.Id)
+		}
+		if found {
+			changed := false
+			err = b.onThread(ctx, threadId, func() error {
+				changed, err = b.applyTaigaStatus(ctx, StatusUpdate{
+					TaskId:   story.Id,
+					ThreadId: threadId,
+					Status:   status,
+				})
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			if changed {
+				b.metrics.add(metricStatusChanges, labels("direction", toDiscord), 1)
+			}
+		}
+	}
+	if payload.Change != nil && (payload.Change.Comment != "" || payload.Change.EditCommentDate != nil || payload.Change.DeleteCommentDate != nil) {
+		return b.onThread(ctx, threadId, func() error {
+			return b.syncTaigaComments(ctx, story.Id, threadId)
+		})
+	}
+	return nil
+}
+
+func (b *Bridge) findStatus(projectId int, statusId int) (Status, bool) {
+	return b.statuses.findById(projectId, statusId)
+}
@@ -0,0 +1,115 @@
+package bridge
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// A "create" webhook for a story that is already synced, like one the bot
+// created from a thread, must not hold on to the only database connection.
+func TestCreateWebhookForMappedStoryReleasesConnection(t *testing.T) {
+	b := newTestBridge(t, &fakeTaiga{})
+	_, err := b.db.Exec("INSERT INTO tasks (thread_id, task_id, status_id, message_id) VALUES ('thread', 7, 1, 'thread')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(WebhookUserStory{Id: 7, Project: WebhookProject{Id: 1}, Status: WebhookStatus{Id: 1}})
+	err = b.handleUserStoryWebhook(context.Background(), 1, WebhookPayload{Action: "create", Type: "userstory", Data: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var one int
+	err = b.db.(*sql.DB).QueryRowContext(ctx, "SELECT 1").Scan(&one)
+	if err != nil {
+		t.Fatalf("database is blocked after the webhook: %v", err)
+	}
+}
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	body := []byte(`{"action":"change"}`)
+	mac := hmac.New(sha1.New, []byte("secret"))
+	mac.Write(body)
+	signature := hex.EncodeToString(mac.Sum(nil))
+	tests := []struct {
+		name      string
+		key       string
+		body      []byte
+		signature string
+		want      bool
+	}{
+		{"valid", "secret", body, signature, true},
+		{"wrong key", "other", body, signature, false},
+		{"changed body", "secret", []byte(`{"action":"delete"}`), signature, false},
+		{"no signature", "secret", body, "", false},
+		{"no key", "", body, signature, false},
+	}
+	for _, test := range tests {
+		if got := verifyWebhookSignature(test.key, test.body, test.signature); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// A status change the thread already has, because a job or command of the
+// thread made it, is not applied again.
+func TestStatusWebhookForAppliedStatus(t *testing.T) {
+	b := newTestBridge(t, &fakeTaiga{})
+	b.statuses.set(1, []Status{{Id: 1, Name: "New"}, {Id: 2, Name: "Done"}})
+	_, err := b.db.Exec("INSERT INTO tasks (thread_id, task_id, status_id, message_id) VALUES ('thread', 7, 1, 'thread')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the job of the thread moved the story before the webhook is handled
+	b.jobs.add("thread", func() {
+		time.Sleep(5 * time.Millisecond)
+		b.db.Exec("UPDATE tasks SET status_id = 2 WHERE task_id = 7")
+	})
+	data, _ := json.Marshal(WebhookUserStory{Id: 7, Project: WebhookProject{Id: 1}, Status: WebhookStatus{Id: 2}})
+	// applying the status again would fail without a Discord connection
+	err = b.handleUserStoryWebhook(context.Background(), 1, WebhookPayload{Action: "change", Type: "userstory", Data: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPublishTagAdded(t *testing.T) {
+	tests := []struct {
+		name string
+		diff string
+		want bool
+	}{
+		{"tag added", `{"tags": {"from": ["bug"], "to": ["bug", "Public"]}}`, true},
+		{"first tag", `{"tags": {"from": null, "to": ["public"]}}`, true},
+		{"colored tags", `{"tags": {"from": [], "to": [["public", "#fff"]]}}`, true},
+		{"tag kept", `{"tags": {"from": ["public"], "to": ["public", "bug"]}}`, false},
+		{"other tag added", `{"tags": {"from": [], "to": ["bug"]}}`, false},
+		{"tag removed", `{"tags": {"from": ["public"], "to": []}}`, false},
+		{"other change", `{"subject": {"from": "a", "to": "b"}}`, false},
+	}
+	b := newTestBridge(t, &fakeTaiga{}, ProjectConfig{Id: 1, ChannelId: "forum", PublishStories: true, PublishTags: []string{"public"}})
+	for _, test := range tests {
+		if got := b.publishTagAdded(1, &WebhookChange{Diff: json.RawMessage(test.diff)}); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// Editing a story that has no forum post does not publish it.
+func TestChangeWebhookWithoutPublishTag(t *testing.T) {
+	b := newTestBridge(t, &fakeTaiga{}, ProjectConfig{Id: 1, ChannelId: "forum", PublishStories: true})
+	data, _ := json.Marshal(WebhookUserStory{Id: 7, Project: WebhookProject{Id: 1}, Status: WebhookStatus{Id: 1}})
+	change := &WebhookChange{Diff: json.RawMessage(`{"subject": {"from": "a", "to": "b"}}`)}
+	// publishing would fail without a Discord connection
+	err := b.handleUserStoryWebhook(context.Background(), 1, WebhookPayload{Action: "change", Type: "userstory", Data: data, Change: change})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
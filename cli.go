@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"taiga-discord/bridge"
+)
+
+// runCommand runs a subcommand instead of the bot.
+func runCommand(db *sql.DB, name string, args []string) error {
+	switch name {
+	case "migrate":
+		return migrate(db)
+	case "reconcile":
+		return reconcile(db, args)
+	case "import":
+		return importExisting(db, args)
+	}
+	return errors.New("unknown command " + name)
+}
+
+// migrate upgrades the database schema, keeping a copy of the database next
+// to it from before the upgrade.
+func migrate(db *sql.DB) error {
+	from, err := bridge.SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	latest := bridge.LatestSchemaVersion()
+	if from == latest {
+		fmt.Println("Database schema is up to date ( version " + strconv.Itoa(latest) + " )")
+		return nil
+	}
+	backupPath := dbPath + ".v" + strconv.Itoa(from) + "-" + time.Now().Format("20060102-150405") + ".bak"
+	_, err = bridge.Migrate(db, backupPath)
+	if err != nil {
+		return err
+	}
+	message := "Migrated database schema from version " + strconv.Itoa(from) + " to " + strconv.Itoa(latest)
+	if _, err := os.Stat(backupPath); err == nil {
+		message += ", backup in " + backupPath
+	}
+	fmt.Println(message)
+	return nil
+}
+
+// reconcile prints the drift between the database, Taiga and Discord and
+// repairs it with --fix.
+func reconcile(db *sql.DB, args []string) error {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	fix := flags.Bool("fix", false, "repair the drift that is found")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	flags.Parse(args)
+	b, _, err := newBridge(db)
+	if err != nil {
+		return err
+	}
+	drifts, err := b.Reconcile(context.Background(), *fix)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if drifts == nil {
+			drifts = []bridge.Drift{}
+		}
+		return encoder.Encode(drifts)
+	}
+	if len(drifts) == 0 {
+		fmt.Println("No drift found")
+		return nil
+	}
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "KIND\tTHREAD\tSTORY\tDETAIL\tFIXED")
+	for _, drift := range drifts {
+		fixed := strconv.FormatBool(drift.Fixed)
+		if drift.Error != "" {
+			fixed = "error: " + drift.Error
+		}
+		story := ""
+		if drift.TaskId != 0 {
+			story = strconv.Itoa(drift.TaskId)
+		}
+		fmt.Fprintln(table, drift.Kind+"\t"+drift.ThreadId+"\t"+story+"\t"+drift.Detail+"\t"+fixed)
+	}
+	return table.Flush()
+}
+
+// importExisting creates stories for the forum threads that are not synced,
+// and threads for the stories without one with --stories. Stopping it with
+// ctrl-c and running it again continues where it stopped.
+func importExisting(db *sql.DB, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only print what would be imported")
+	stories := flags.Bool("stories", false, "also create threads for stories without one")
+	closed := flags.Bool("closed", false, "include stories in a closed status with --stories")
+	delay := flags.Duration("delay", 500*time.Millisecond, "pause before every write")
+	flags.Parse(args)
+	b, _, err := newBridge(db)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	verb := "Imported"
+	if *dryRun {
+		verb = "Would import"
+	}
+	threads, storyCount, failed := 0, 0, 0
+	err = b.Import(ctx, bridge.ImportOptions{
+		DryRun:  *dryRun,
+		Stories: *stories,
+		Closed:  *closed,
+		Delay:   *delay,
+		Report: func(item bridge.ImportItem) {
+			var message string
+			if item.Kind == bridge.ImportThread {
+				message = verb + " thread " + item.ThreadId + " \"" + item.Name + "\" with " + strconv.Itoa(item.Comments) + " comments"
+				if item.TaskId != 0 {
+					message += " as story " + strconv.Itoa(item.TaskId)
+				}
+			} else {
+				message = verb + " story " + strconv.Itoa(item.TaskId) + " \"" + item.Name + "\""
+				if item.ThreadId != "" {
+					message += " as thread " + item.ThreadId
+				}
+			}
+			if item.Error != "" {
+				message += ", failed: " + item.Error
+				failed++
+			} else if item.Kind == bridge.ImportThread {
+				threads++
+			} else {
+				storyCount++
+			}
+			fmt.Println(message)
+		},
+	})
+	fmt.Println(verb + " " + strconv.Itoa(threads) + " threads and " + strconv.Itoa(storyCount) + " stories, " + strconv.Itoa(failed) + " failed")
+	return err
+}
@@ -0,0 +1,67 @@
+package taiga
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+type Attachment struct {
+	Id         int    `json:"id"`
+	Name       string `json:"name"`
+	ObjectId   int    `json:"object_id"`
+	PreviewURL string `json:"preview_url"`
+	URL        string `json:"url"`
+}
+
+// UploadAttachment attaches a file to a story.
+func (c *Client) UploadAttachment(ctx context.Context, projectId int, storyId int, filename string, content io.Reader) (Attachment, error) {
+	formData := new(bytes.Buffer)
+	writer := multipart.NewWriter(formData)
+	part, err := writer.CreateFormFile("attached_file", filename)
+	if err != nil {
+		return Attachment{}, err
+	}
+	_, err = io.Copy(part, content)
+	if err != nil {
+		return Attachment{}, err
+	}
+	err = writer.WriteField("object_id", strconv.Itoa(storyId))
+	if err != nil {
+		return Attachment{}, err
+	}
+	err = writer.WriteField("project", strconv.Itoa(projectId))
+	if err != nil {
+		return Attachment{}, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return Attachment{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.url("/userstories/attachments", nil), formData)
+	if err != nil {
+		return Attachment{}, err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	var attachment Attachment
+	_, err = c.send(req, &attachment)
+	return attachment, err
+}
+
+func (c *Client) ListAttachments(ctx context.Context, projectId int, storyId int) ([]Attachment, error) {
+	query := url.Values{}
+	query.Set("project", strconv.Itoa(projectId))
+	query.Set("object_id", strconv.Itoa(storyId))
+	var attachments []Attachment
+	_, err := c.do(ctx, "GET", "/userstories/attachments", query, nil, &attachments)
+	return attachments, err
+}
+
+func (c *Client) DeleteAttachment(ctx context.Context, id int) error {
+	_, err := c.do(ctx, "DELETE", "/userstories/attachments/"+strconv.Itoa(id), nil, nil, nil)
+	return err
+}
@@ -0,0 +1,101 @@
+package taiga
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type tokens struct {
+	userId         int
+	authToken      string
+	authExpires    time.Time
+	refreshToken   string
+	refreshExpires time.Time
+}
+
+type authRequest struct {
+	Type     string `json:"type"`
+	Password string `json:"password"`
+	Username string `json:"username"`
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh"`
+}
+
+type authResponse struct {
+	Id           int    `json:"id"`
+	Token        string `json:"auth_token"`
+	RefreshToken string `json:"refresh"`
+}
+
+// authToken returns a valid token, refreshing it or logging in again when it
+// has expired.
+func (c *Client) authToken(ctx context.Context) (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	if c.tokens.authToken != "" && c.tokens.authExpires.After(now) {
+		return c.tokens.authToken, nil
+	}
+	if c.tokens.authToken != "" && c.tokens.refreshExpires.After(now) {
+		var resp authResponse
+		err := c.post(ctx, "/auth/refresh", refreshRequest{RefreshToken: c.tokens.refreshToken}, &resp)
+		if err == nil {
+			c.tokens.authToken = resp.Token
+			c.tokens.authExpires = now.Add(24 * time.Hour)
+			return resp.Token, nil
+		}
+	}
+	var resp authResponse
+	err := c.post(ctx, "/auth", authRequest{Type: "normal", Password: c.password, Username: c.username}, &resp)
+	if err != nil {
+		return "", err
+	}
+	c.tokens = tokens{
+		userId:         resp.Id,
+		authToken:      resp.Token,
+		authExpires:    now.Add(24 * time.Hour),
+		refreshToken:   resp.RefreshToken,
+		refreshExpires: now.Add(8 * 24 * time.Hour),
+	}
+	return resp.Token, nil
+}
+
+// invalidateToken forgets token so the next request gets a new one, unless
+// another request already replaced it.
+func (c *Client) invalidateToken(token string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.tokens.authToken == token {
+		c.tokens.authExpires = time.Time{}
+	}
+}
+
+func (c *Client) post(ctx context.Context, path string, body any, out any) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.url(path, nil), bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	_, err = c.roundTrip(req, out)
+	return err
+}
+
+// UserID returns the id of the account the client is logged in as.
+func (c *Client) UserID(ctx context.Context) (int, error) {
+	_, err := c.authToken(ctx)
+	if err != nil {
+		return 0, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.tokens.userId, nil
+}
@@ -0,0 +1,143 @@
+// Package taiga is a client for the parts of the Taiga REST API used by the
+// bridge.
+package taiga
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultTimeout = 30 * time.Second
+
+type Client struct {
+	baseURL  string
+	username string
+	password string
+	http     *http.Client
+
+	// OnRequest is called after every request with the request's context and
+	// its endpoint, the path with ids replaced by {id}. statusCode is 0 when no
+	// response was received.
+	OnRequest func(ctx context.Context, method string, endpoint string, statusCode int, duration time.Duration)
+
+	lock   sync.Mutex
+	tokens tokens
+}
+
+// NewClient returns a client for the Taiga instance at baseURL that logs in
+// with the given account. All requests share one HTTP client.
+func NewClient(baseURL string, username string, password string) *Client {
+	return &Client{
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		username: username,
+		password: password,
+		http:     &http.Client{Timeout: defaultTimeout},
+	}
+}
+
+// BaseURL returns the address of the Taiga instance.
+func (c *Client) BaseURL() string {
+	return c.baseURL
+}
+
+func (c *Client) url(path string, query url.Values) string {
+	address := c.baseURL + "/api/v1" + path
+	if len(query) > 0 {
+		address += "?" + query.Encode()
+	}
+	return address
+}
+
+// do sends a JSON request and decodes the response into out.
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, body any, out any) (http.Header, error) {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.url(path, query), reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.send(req, out)
+}
+
+// send authenticates and sends a prepared request. When Taiga no longer
+// accepts the token, for example after a restart of Taiga, it logs in again
+// and sends the request once more.
+func (c *Client) send(req *http.Request, out any) (http.Header, error) {
+	token, err := c.authToken(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	header, err := c.roundTrip(req, out)
+	var taigaErr *Error
+	if !errors.As(err, &taigaErr) || taigaErr.StatusCode != http.StatusUnauthorized || (req.Body != nil && req.GetBody == nil) {
+		return header, err
+	}
+	c.invalidateToken(token)
+	token, err = c.authToken(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		retry.Body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+	retry.Header.Set("Authorization", "Bearer "+token)
+	return c.roundTrip(retry, out)
+}
+
+func (c *Client) roundTrip(req *http.Request, out any) (http.Header, error) {
+	start := time.Now()
+	resp, err := c.http.Do(req)
+	if c.OnRequest != nil {
+		statusCode := 0
+		if resp != nil {
+			statusCode = resp.StatusCode
+		}
+		c.OnRequest(req.Context(), req.Method, endpoint(req.URL.Path), statusCode, time.Since(start))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, newError(resp, string(body))
+	}
+	if out == nil {
+		return resp.Header, nil
+	}
+	return resp.Header, json.NewDecoder(resp.Body).Decode(out)
+}
+
+// endpoint turns a request path into a name for the endpoint, without the ids
+// that would make every story its own endpoint.
+func endpoint(path string) string {
+	segments := strings.Split(strings.TrimPrefix(path, "/api/v1"), "/")
+	for i, segment := range segments {
+		if segment != "" && strings.Trim(segment, "0123456789") == "" {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,75 @@
+package taiga
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// testServer is a Taiga that hands out numbered tokens and accepts only the
+// ones in valid.
+type testServer struct {
+	lock     sync.Mutex
+	issued   int
+	valid    map[string]bool
+	requests int
+}
+
+func (s *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch r.URL.Path {
+	case "/api/v1/auth", "/api/v1/auth/refresh":
+		s.issued++
+		json.NewEncoder(w).Encode(authResponse{Id: 1, Token: "token" + strconv.Itoa(s.issued), RefreshToken: "refresh"})
+	case "/api/v1/userstories/7":
+		s.requests++
+		if !s.valid[r.Header.Get("Authorization")] {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(UserStory{Id: 7, Version: 3})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestRetryWithNewToken(t *testing.T) {
+	tests := []struct {
+		name         string
+		valid        []string
+		wantErr      error
+		wantRequests int
+	}{
+		{name: "token accepted", valid: []string{"Bearer token1"}, wantRequests: 1},
+		{name: "token revoked", valid: []string{"Bearer token2"}, wantRequests: 2},
+		{name: "account locked", wantErr: ErrUnauthorized, wantRequests: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			taiga := &testServer{valid: make(map[string]bool)}
+			for _, token := range test.valid {
+				taiga.valid[token] = true
+			}
+			server := httptest.NewServer(taiga)
+			defer server.Close()
+			client := NewClient(server.URL, "bot", "secret")
+			story, err := client.GetUserStory(context.Background(), 7)
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Errorf("got error %v, want %v", err, test.wantErr)
+				}
+			} else if err != nil || story.Version != 3 {
+				t.Errorf("got story %+v and error %v", story, err)
+			}
+			if taiga.requests != test.wantRequests {
+				t.Errorf("sent %d requests, want %d", taiga.requests, test.wantRequests)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package taiga
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound        = errors.New("taiga: not found")
+	ErrVersionConflict = errors.New("taiga: version conflict")
+	ErrRateLimited     = errors.New("taiga: rate limited")
+	ErrUnauthorized    = errors.New("taiga: unauthorized")
+)
+
+// Error is returned for every response outside of 2xx. It matches one of the
+// sentinel errors with errors.Is when the status code has a known meaning.
+type Error struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration
+	kind       error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("taiga: %s %s responded with %d: %s", e.Method, e.Path, e.StatusCode, e.Body)
+}
+
+func (e *Error) Unwrap() error {
+	return e.kind
+}
+
+// Temporary reports whether the same request may succeed later.
+func (e *Error) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusRequestTimeout
+}
+
+func newError(resp *http.Response, body string) *Error {
+	err := &Error{
+		Method:     resp.Request.Method,
+		Path:       resp.Request.URL.Path,
+		StatusCode: resp.StatusCode,
+		Body:       body,
+	}
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		err.kind = ErrNotFound
+	case http.StatusUnauthorized, http.StatusForbidden:
+		err.kind = ErrUnauthorized
+	case http.StatusTooManyRequests:
+		err.kind = ErrRateLimited
+		if seconds, parseErr := strconv.Atoi(resp.Header.Get("Retry-After")); parseErr == nil {
+			err.RetryAfter = time.Duration(seconds) * time.Second
+		}
+	case http.StatusBadRequest:
+		// optimistic concurrency errors are reported on the version field
+		if strings.Contains(body, `"version"`) {
+			err.kind = ErrVersionConflict
+		}
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+package taiga
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+type HistoryUser struct {
+	Pk       int    `json:"pk"`
+	Username string `json:"username"`
+	Name     string `json:"name"`
+}
+
+type HistoryEntry struct {
+	Id                string      `json:"id"`
+	Comment           string      `json:"comment"`
+	CreatedAt         string      `json:"created_at"`
+	User              HistoryUser `json:"user"`
+	DeleteCommentDate *string     `json:"delete_comment_date"`
+	EditCommentDate   *string     `json:"edit_comment_date"`
+	// Diff holds the old and new value of every changed field.
+	Diff map[string]json.RawMessage `json:"diff"`
+}
+
+// StatusChange returns the ids of the statuses the entry moved the story
+// between, if it changed the status.
+func (e HistoryEntry) StatusChange() (int, int, bool) {
+	var change []*int
+	err := json.Unmarshal(e.Diff["status"], &change)
+	if err != nil || len(change) != 2 || change[0] == nil || change[1] == nil {
+		return 0, 0, false
+	}
+	return *change[0], *change[1], true
+}
+
+// GetUserStoryHistory returns the history of a story, newest entry first.
+func (c *Client) GetUserStoryHistory(ctx context.Context, storyId int) ([]HistoryEntry, error) {
+	var entries []HistoryEntry
+	_, err := c.do(ctx, "GET", "/history/userstory/"+strconv.Itoa(storyId), nil, nil, &entries)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].CreatedAt > entries[j].CreatedAt
+	})
+	return entries, nil
+}
+
+type commentRequest struct {
+	Comment string `json:"comment"`
+}
+
+// AddComment comments on a story. Comments are added by patching the story,
+// so the story's current version is needed.
+func (c *Client) AddComment(ctx context.Context, storyId int, version int, comment string) (UserStory, error) {
+	return c.PatchUserStory(ctx, storyId, version, map[string]any{"comment": comment})
+}
+
+func (c *Client) EditComment(ctx context.Context, storyId int, commentId string, comment string) error {
+	query := url.Values{}
+	query.Set("id", commentId)
+	_, err := c.do(ctx, "POST", "/history/userstory/"+strconv.Itoa(storyId)+"/edit_comment", query, commentRequest{Comment: comment}, nil)
+	return err
+}
+
+func (c *Client) DeleteComment(ctx context.Context, storyId int, commentId string) error {
+	query := url.Values{}
+	query.Set("id", commentId)
+	_, err := c.do(ctx, "POST", "/history/userstory/"+strconv.Itoa(storyId)+"/delete_comment", query, nil, nil)
+	return err
+}
@@ -0,0 +1,98 @@
+package taiga
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+type Status struct {
+	Id       int    `json:"id"`
+	Name     string `json:"name"`
+	Slug     string `json:"slug"`
+	Order    int    `json:"order"`
+	IsClosed bool   `json:"is_closed"`
+	Color    string `json:"color"`
+}
+
+type Point struct {
+	Id    int      `json:"id"`
+	Name  string   `json:"name"`
+	Value *float64 `json:"value"`
+	Order int      `json:"order"`
+}
+
+type Role struct {
+	Id         int    `json:"id"`
+	Name       string `json:"name"`
+	Computable bool   `json:"computable"`
+	Order      int    `json:"order"`
+}
+
+type Project struct {
+	Id              int     `json:"id"`
+	Name            string  `json:"name"`
+	Slug            string  `json:"slug"`
+	DefaultUsStatus int     `json:"default_us_status"`
+	Points          []Point `json:"points"`
+	Roles           []Role  `json:"roles"`
+}
+
+type Membership struct {
+	Id       int    `json:"id"`
+	User     *int   `json:"user"`
+	FullName string `json:"full_name"`
+	RoleName string `json:"role_name"`
+}
+
+type User struct {
+	Id       int    `json:"id"`
+	Username string `json:"username"`
+	FullName string `json:"full_name_display"`
+	Bio      string `json:"bio"`
+}
+
+// ListUserStoryStatuses returns the statuses of a project in board order.
+func (c *Client) ListUserStoryStatuses(ctx context.Context, projectId int) ([]Status, error) {
+	query := url.Values{}
+	query.Set("project", strconv.Itoa(projectId))
+	var statuses []Status
+	_, err := c.do(ctx, "GET", "/userstory-statuses", query, nil, &statuses)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Order < statuses[j].Order
+	})
+	return statuses, nil
+}
+
+func (c *Client) GetProject(ctx context.Context, id int) (Project, error) {
+	var project Project
+	_, err := c.do(ctx, "GET", "/projects/"+strconv.Itoa(id), nil, nil, &project)
+	return project, err
+}
+
+// GetTagsColors returns the tags used in a project with their colors.
+func (c *Client) GetTagsColors(ctx context.Context, projectId int) (map[string]*string, error) {
+	var tags map[string]*string
+	_, err := c.do(ctx, "GET", "/projects/"+strconv.Itoa(projectId)+"/tags_colors", nil, nil, &tags)
+	return tags, err
+}
+
+func (c *Client) ListMemberships(ctx context.Context, projectId int) ([]Membership, error) {
+	query := url.Values{}
+	query.Set("project", strconv.Itoa(projectId))
+	var memberships []Membership
+	_, err := c.do(ctx, "GET", "/memberships", query, nil, &memberships)
+	return memberships, err
+}
+
+func (c *Client) GetUserByUsername(ctx context.Context, username string) (User, error) {
+	query := url.Values{}
+	query.Set("username", username)
+	var user User
+	_, err := c.do(ctx, "GET", "/users/by_username", query, nil, &user)
+	return user, err
+}
@@ -0,0 +1,138 @@
+package taiga
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+const pageSize = 100
+
+type UserStory struct {
+	Id          int             `json:"id"`
+	Ref         int             `json:"ref"`
+	Project     int             `json:"project"`
+	Subject     string          `json:"subject"`
+	Description string          `json:"description"`
+	Version     int             `json:"version"`
+	Status      int             `json:"status"`
+	KanbanOrder int             `json:"kanban_order"`
+	AssignedTo  *int            `json:"assigned_to"`
+	Points      map[string]int  `json:"points"`
+	Tags        json.RawMessage `json:"tags"`
+	DueDate     *string         `json:"due_date"`
+	IsBlocked   bool            `json:"is_blocked"`
+	BlockedNote string          `json:"blocked_note"`
+	Watchers    []int           `json:"watchers"`
+	Milestone   *int            `json:"milestone"`
+	// MilestoneName is the name of the sprint, empty without one.
+	MilestoneName string `json:"milestone_name"`
+	CreatedDate   string `json:"created_date"`
+	ModifiedDate  string `json:"modified_date"`
+}
+
+// TagNames returns the names of the story's tags. Taiga sends them either as
+// plain names or as [name, color] pairs.
+func (s UserStory) TagNames() []string {
+	return ParseTags(s.Tags)
+}
+
+func ParseTags(raw json.RawMessage) []string {
+	var tags []string
+	if json.Unmarshal(raw, &tags) == nil {
+		return tags
+	}
+	var coloredTags [][]*string
+	if json.Unmarshal(raw, &coloredTags) != nil {
+		return nil
+	}
+	for _, tag := range coloredTags {
+		if len(tag) > 0 && tag[0] != nil {
+			tags = append(tags, *tag[0])
+		}
+	}
+	return tags
+}
+
+type NewUserStory struct {
+	Project     int    `json:"project"`
+	Subject     string `json:"subject"`
+	Description string `json:"description"`
+	Status      int    `json:"status"`
+	KanbanOrder int    `json:"kanban_order"`
+}
+
+// ListUserStories returns every story of a project in a status, ordered like
+// the kanban board.
+func (c *Client) ListUserStories(ctx context.Context, projectId int, statusId int) ([]UserStory, error) {
+	var stories []UserStory
+	for page := 1; ; page++ {
+		query := url.Values{}
+		query.Set("project", strconv.Itoa(projectId))
+		query.Set("status", strconv.Itoa(statusId))
+		query.Set("page_size", strconv.Itoa(pageSize))
+		query.Set("page", strconv.Itoa(page))
+		var pageStories []UserStory
+		header, err := c.do(ctx, "GET", "/userstories", query, nil, &pageStories)
+		if err != nil {
+			return nil, err
+		}
+		stories = append(stories, pageStories...)
+		count, err := strconv.Atoi(header.Get("x-pagination-count"))
+		if err != nil || page*pageSize >= count {
+			break
+		}
+	}
+	sort.Slice(stories, func(i, j int) bool {
+		return stories[i].KanbanOrder < stories[j].KanbanOrder
+	})
+	return stories, nil
+}
+
+func (c *Client) GetUserStory(ctx context.Context, id int) (UserStory, error) {
+	var story UserStory
+	_, err := c.do(ctx, "GET", "/userstories/"+strconv.Itoa(id), nil, nil, &story)
+	return story, err
+}
+
+func (c *Client) CreateUserStory(ctx context.Context, story NewUserStory) (UserStory, error) {
+	var created UserStory
+	_, err := c.do(ctx, "POST", "/userstories", nil, story, &created)
+	return created, err
+}
+
+// PatchUserStory changes the given fields of a story. Taiga rejects the change
+// with ErrVersionConflict unless version is the story's current version.
+func (c *Client) PatchUserStory(ctx context.Context, id int, version int, fields map[string]any) (UserStory, error) {
+	body := make(map[string]any, len(fields)+1)
+	for key, value := range fields {
+		body[key] = value
+	}
+	body["version"] = version
+	var story UserStory
+	_, err := c.do(ctx, "PATCH", "/userstories/"+strconv.Itoa(id), nil, body, &story)
+	return story, err
+}
+
+func (c *Client) DeleteUserStory(ctx context.Context, id int) error {
+	_, err := c.do(ctx, "DELETE", "/userstories/"+strconv.Itoa(id), nil, nil, nil)
+	return err
+}
+
+type bulkOrderRequest struct {
+	Project int   `json:"project_id"`
+	Stories []int `json:"bulk_userstories"`
+	Status  int   `json:"status_id"`
+}
+
+// BulkUpdateKanbanOrder puts the stories of a status in the given order.
+func (c *Client) BulkUpdateKanbanOrder(ctx context.Context, projectId int, statusId int, storyIds []int) error {
+	_, err := c.do(ctx, "POST", "/userstories/bulk_update_kanban_order", nil, bulkOrderRequest{
+		Project: projectId,
+		Stories: storyIds,
+		Status:  statusId,
+	}, nil)
+	return err
+}